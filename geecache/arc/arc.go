@@ -0,0 +1,290 @@
+package arc
+
+import (
+	"container/list"
+	"geecache/lru"
+	"time"
+)
+
+// Cache is an ARC (Adaptive Replacement Cache) bounded by bytes.
+// It is not safe for concurrent access.
+//
+// Entries seen once live in t1 and entries seen again move to t2. Keys
+// evicted from t1 and t2 are remembered in the ghost lists b1 and b2,
+// and hits on those ghosts shift the target size p of t1, so a scan over
+// new keys only flushes t1 while the frequently used entries stay in t2.
+type Cache struct {
+	maxBytes int64
+	// p is the target size of t1 in bytes
+	p      int64
+	t1, t2 *list.List // resident entries, most recent at the front
+	b1, b2 *list.List // ghost entries, holding only key and size
+	cache  map[string]*list.Element
+	ghosts map[string]*list.Element
+	// optional and executed when an entry is purged.
+	OnEvicted func(key string, value lru.Value, reason lru.EvictReason)
+	// now returns the current time, replaced in tests
+	now func() time.Time
+
+	nbytes           int64 // bytes in t1 and t2
+	t1Bytes          int64
+	b1Bytes, b2Bytes int64
+}
+
+type entry struct {
+	key   string
+	value lru.Value
+	// expire is the deadline of the entry, zero means it never expires
+	expire time.Time
+	// list is the list holding the entry
+	list *list.List
+}
+
+// ghost is a key recently evicted from t1 or t2.
+type ghost struct {
+	key  string
+	size int64
+	list *list.List
+}
+
+// expired reports whether the entry's deadline has passed at t.
+func (e *entry) expired(t time.Time) bool {
+	return !e.expire.IsZero() && !t.Before(e.expire)
+}
+
+func (e *entry) size() int64 {
+	return int64(len(e.key)) + int64(e.value.Len())
+}
+
+// New is the Constructor of Cache
+func New(maxBytes int64, onEvicted func(string, lru.Value, lru.EvictReason)) *Cache {
+	return &Cache{
+		maxBytes:  maxBytes,
+		t1:        list.New(),
+		t2:        list.New(),
+		b1:        list.New(),
+		b2:        list.New(),
+		cache:     make(map[string]*list.Element),
+		ghosts:    make(map[string]*list.Element),
+		OnEvicted: onEvicted,
+		now:       time.Now,
+	}
+}
+
+// Add adds a value to the cache.
+func (c *Cache) Add(key string, value lru.Value) {
+	c.AddWithTTL(key, value, 0)
+}
+
+// AddWithTTL adds a value to the cache that expires after ttl.
+// A ttl <= 0 means the value never expires.
+func (c *Cache) AddWithTTL(key string, value lru.Value, ttl time.Duration) {
+	var expire time.Time
+	if ttl > 0 {
+		expire = c.now().Add(ttl)
+	}
+	if ele, ok := c.cache[key]; ok {
+		kv := ele.Value.(*entry)
+		c.unlink(ele)
+		kv.value = value
+		kv.expire = expire
+		c.push(c.t2, kv)
+		c.replace()
+		return
+	}
+
+	kv := &entry{key: key, value: value, expire: expire}
+	size := kv.size()
+	if ele, ok := c.ghosts[key]; ok {
+		// A ghost hit means the list it was evicted from was too small.
+		g := ele.Value.(*ghost)
+		if g.list == c.b1 {
+			c.p = min64(c.p+size*max64(1, c.b2Bytes/max64(c.b1Bytes, 1)), c.maxBytes)
+		} else {
+			c.p = max64(c.p-size*max64(1, c.b1Bytes/max64(c.b2Bytes, 1)), 0)
+		}
+		c.removeGhost(ele)
+		c.push(c.t2, kv)
+	} else {
+		c.push(c.t1, kv)
+	}
+	c.replace()
+	c.trimGhosts()
+}
+
+// Get look ups a key's value
+// An expired entry reads as a miss and is removed.
+func (c *Cache) Get(key string) (value lru.Value, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		kv := ele.Value.(*entry)
+		if kv.expired(c.now()) {
+			c.removeElement(ele, lru.EvictExpired)
+			return nil, false
+		}
+		c.unlink(ele)
+		c.push(c.t2, kv)
+		return kv.value, true
+	}
+	return
+}
+
+// Peek looks up a key's value like Get, without marking it used. An
+// expired entry reads as a miss but is left to be reclaimed.
+func (c *Cache) Peek(key string) (value lru.Value, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		if kv := ele.Value.(*entry); !kv.expired(c.now()) {
+			return kv.value, true
+		}
+	}
+	return
+}
+
+// Remove removes the key you need and reports whether it was present.
+// An expired entry is reclaimed but reported as absent.
+func (c *Cache) Remove(key string) bool {
+	if ele, ok := c.ghosts[key]; ok {
+		c.removeGhost(ele)
+	}
+	if ele, hit := c.cache[key]; hit {
+		if ele.Value.(*entry).expired(c.now()) {
+			c.removeElement(ele, lru.EvictExpired)
+			return false
+		}
+		c.removeElement(ele, lru.EvictDeleted)
+		return true
+	}
+	return false
+}
+
+// RemoveExpired removes every expired entry and returns how many were removed.
+func (c *Cache) RemoveExpired() int {
+	now := c.now()
+	removed := 0
+	for _, ele := range c.cache {
+		if ele.Value.(*entry).expired(now) {
+			c.removeElement(ele, lru.EvictExpired)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Range calls f for every entry that has not expired, with the time it
+// has left or 0 if it never expires, until f returns false. f must not
+// modify the cache.
+func (c *Cache) Range(f func(key string, value lru.Value, ttl time.Duration) bool) {
+	now := c.now()
+	for key, ele := range c.cache {
+		kv := ele.Value.(*entry)
+		if kv.expired(now) {
+			continue
+		}
+		var ttl time.Duration
+		if !kv.expire.IsZero() {
+			ttl = kv.expire.Sub(now)
+		}
+		if !f(key, kv.value, ttl) {
+			return
+		}
+	}
+}
+
+// Len the number of cache entries
+func (c *Cache) Len() int {
+	return len(c.cache)
+}
+
+// Bytes the number of bytes taken by keys and values
+func (c *Cache) Bytes() int64 {
+	return c.nbytes
+}
+
+// replace evicts from t1 or t2, depending on p, until the entries fit
+// in maxBytes. Evicted keys are remembered as ghosts.
+func (c *Cache) replace() {
+	for c.maxBytes != 0 && c.maxBytes < c.nbytes {
+		var ele *list.Element
+		var ghosts *list.List
+		if c.t1.Len() > 0 && (c.t1Bytes > c.p || c.t2.Len() == 0) {
+			ele, ghosts = c.t1.Back(), c.b1
+		} else {
+			ele, ghosts = c.t2.Back(), c.b2
+		}
+		kv := ele.Value.(*entry)
+		c.removeElement(ele, lru.EvictCapacity)
+		g := &ghost{key: kv.key, size: kv.size(), list: ghosts}
+		c.ghosts[kv.key] = ghosts.PushFront(g)
+		if ghosts == c.b1 {
+			c.b1Bytes += g.size
+		} else {
+			c.b2Bytes += g.size
+		}
+	}
+}
+
+// trimGhosts keeps t1 plus b1 within maxBytes, and all four lists within
+// twice maxBytes.
+func (c *Cache) trimGhosts() {
+	if c.maxBytes == 0 {
+		return
+	}
+	for c.b1.Len() > 0 && c.t1Bytes+c.b1Bytes > c.maxBytes {
+		c.removeGhost(c.b1.Back())
+	}
+	for c.b2.Len() > 0 && c.nbytes+c.b1Bytes+c.b2Bytes > 2*c.maxBytes {
+		c.removeGhost(c.b2.Back())
+	}
+}
+
+func (c *Cache) push(l *list.List, kv *entry) {
+	kv.list = l
+	c.cache[kv.key] = l.PushFront(kv)
+	c.nbytes += kv.size()
+	if l == c.t1 {
+		c.t1Bytes += kv.size()
+	}
+}
+
+// unlink takes the element out of t1 or t2 and the byte counts.
+func (c *Cache) unlink(ele *list.Element) {
+	kv := ele.Value.(*entry)
+	kv.list.Remove(ele)
+	delete(c.cache, kv.key)
+	c.nbytes -= kv.size()
+	if kv.list == c.t1 {
+		c.t1Bytes -= kv.size()
+	}
+}
+
+func (c *Cache) removeElement(ele *list.Element, reason lru.EvictReason) {
+	kv := ele.Value.(*entry)
+	c.unlink(ele)
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value, reason)
+	}
+}
+
+func (c *Cache) removeGhost(ele *list.Element) {
+	g := ele.Value.(*ghost)
+	g.list.Remove(ele)
+	delete(c.ghosts, g.key)
+	if g.list == c.b1 {
+		c.b1Bytes -= g.size
+	} else {
+		c.b2Bytes -= g.size
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
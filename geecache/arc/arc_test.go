@@ -0,0 +1,99 @@
+package arc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestGet(t *testing.T) {
+	arc := New(int64(0), nil)
+	arc.Add("key1", String("1234"))
+	if v, ok := arc.Get("key1"); !ok || string(v.(String)) != "1234" {
+		t.Fatalf("cache hit key1=1234 failed")
+	}
+	if _, ok := arc.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+}
+
+func TestPeek(t *testing.T) {
+	arc := New(int64(0), nil)
+	arc.Add("key1", String("1234"))
+	if v, ok := arc.Peek("key1"); !ok || string(v.(String)) != "1234" {
+		t.Fatalf("peek key1=1234 failed")
+	}
+	if _, ok := arc.Peek("key2"); ok {
+		t.Fatalf("peek miss key2 failed")
+	}
+	// A second Get would move key1 to t2, a peek leaves it in t1.
+	if arc.t1.Len() != 1 || arc.t2.Len() != 0 {
+		t.Fatalf("peek moved key1: t1=%d t2=%d", arc.t1.Len(), arc.t2.Len())
+	}
+}
+
+func TestScanResistance(t *testing.T) {
+	// Room for ten 4 byte entries.
+	arc := New(int64(40), nil)
+	hot := []string{"h1", "h2", "h3", "h4"}
+	for _, k := range hot {
+		arc.Add(k, String("vv"))
+		arc.Get(k)
+	}
+	for i := 0; i < 100; i++ {
+		arc.Add(fmt.Sprintf("s%d", i%100), String("v"))
+	}
+	for _, k := range hot {
+		if _, ok := arc.Get(k); !ok {
+			t.Fatalf("hot key %s was flushed by a scan", k)
+		}
+	}
+	if arc.Bytes() > 40 {
+		t.Fatalf("cache holds %d bytes, more than 40", arc.Bytes())
+	}
+}
+
+func TestGhostHit(t *testing.T) {
+	arc := New(int64(8), nil)
+	arc.Add("k1", String("v1"))
+	arc.Add("k2", String("v2"))
+	arc.Get("k2")
+	arc.Add("k3", String("v3"))
+	if _, ok := arc.cache["k1"]; ok {
+		t.Fatalf("k1 should have been evicted")
+	}
+	if _, ok := arc.ghosts["k1"]; !ok {
+		t.Fatalf("evicted k1 should be remembered as a ghost")
+	}
+	// Adding k1 again is a ghost hit that grows t1's target.
+	arc.Add("k1", String("v1"))
+	if arc.p == 0 {
+		t.Fatalf("ghost hit in b1 should increase p")
+	}
+	if _, ok := arc.Get("k1"); !ok || arc.Len() != 2 || arc.Bytes() != 8 {
+		t.Fatalf("len=%d bytes=%d after ghost hit", arc.Len(), arc.Bytes())
+	}
+}
+
+func TestRemove(t *testing.T) {
+	now := time.Now()
+	arc := New(int64(0), nil)
+	arc.now = func() time.Time { return now }
+	arc.Add("key1", String("1234"))
+	arc.Get("key1")
+	arc.AddWithTTL("key2", String("5678"), time.Second)
+
+	if !arc.Remove("key1") || arc.Remove("key1") {
+		t.Fatalf("Remove key1 should succeed exactly once")
+	}
+	now = now.Add(time.Second)
+	if n := arc.RemoveExpired(); n != 1 || arc.Len() != 0 || arc.Bytes() != 0 {
+		t.Fatalf("RemoveExpired removed %d, len=%d bytes=%d", n, arc.Len(), arc.Bytes())
+	}
+}
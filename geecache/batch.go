@@ -0,0 +1,576 @@
+package geecache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	pb "geecache/geecachepb"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// batchParallelism bounds the requests of a batch a peer runs at once, and
+// the keys of a batch a group loads itself at once.
+const batchParallelism = 16
+
+// A Result is the outcome for one key of GetMany, SetMany or DeleteMany.
+type Result struct {
+	Key string
+	// Value is the value GetMany got.
+	Value ByteView
+	// Deleted tells whether DeleteMany deleted the key.
+	Deleted bool
+	// Err is the key's error, ErrNotFound for a key GetMany found missing.
+	Err error
+}
+
+// GetMany gets several keys like Get, and returns their results in the
+// order of keys. The keys owned by other peers are asked in one request
+// per peer, all peers in parallel. Their loads are deduplicated with the
+// ones of Get: a key already being loaded waits for that load, and Get
+// calls of the keys asked wait for the request.
+func (g *Group) GetMany(ctx context.Context, keys []string) []Result {
+	results := newResults(keys)
+	g.forEachOwner(keys, func(i int) {
+		results[i].Value, _, results[i].Err = g.GetWithSource(ctx, keys[i], false)
+	}, func(peer PeerGetter, idx []int) {
+		var (
+			reqs    []*pb.Request
+			sent    []int
+			finish  []func(interface{}, error)
+			waiting []int // keys being loaded already
+		)
+		// old holds the values kept past their hard TTL, see loadOrStale.
+		old := make(map[int]ByteView)
+		for _, i := range idx {
+			g.Stats.Gets.Add(1)
+			key := keys[i]
+			if key == "" {
+				results[i].Err = fmt.Errorf("key is required")
+				continue
+			}
+			v, hit, ok := g.lookupCache(key, false)
+			if hit {
+				results[i].Value, _, results[i].Err = g.cacheHit(v)
+				continue
+			}
+			if ok {
+				old[i] = v
+			}
+			done, ok := g.loader.Start(ctx, key)
+			if !ok {
+				waiting = append(waiting, i)
+				continue
+			}
+			g.Stats.Loads.Add(1)
+			g.Stats.LoadsDeduped.Add(1)
+			reqs = append(reqs, &pb.Request{Group: g.name, Key: key})
+			sent = append(sent, i)
+			finish = append(finish, done)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runParallel(len(waiting), func(j int) {
+				i := waiting[j]
+				v, ok := old[i]
+				results[i].Value, _, results[i].Err = g.loadOrStale(ctx, keys[i], false, v, ok)
+			})
+		}()
+		defer wg.Wait()
+		if len(reqs) == 0 {
+			return
+		}
+
+		res, err := g.sendBatch(ctx, peer, mgetPath, reqs)
+		if err != nil {
+			g.Stats.PeerErrors.Add(1)
+			log.Println("[GeeCache] Failed to get from peer", err)
+			// Loaded with the Getter, as Get does when the owner cannot be asked.
+			runParallel(len(sent), func(j int) {
+				var val interface{}
+				err := ctx.Err()
+				if err == nil {
+					val, err = g.loadLocal(ctx, keys[sent[j]])
+				}
+				finish[j](val, err)
+				v, ok := old[sent[j]]
+				g.setLoaded(ctx, &results[sent[j]], val, err, v, ok)
+			})
+			return
+		}
+		for j, i := range sent {
+			key := keys[i]
+			err := resultErr(res[j].Error)
+			var val interface{}
+			switch {
+			case err == nil:
+				g.Stats.PeerLoads.Add(1)
+				value := ByteView{b: res[j].Value, version: res[j].Version, stale: res[j].Stale}
+				if !value.stale {
+					g.admitHot(key, value)
+				}
+				val = loadResult{value, FromPeer}
+			case errors.Is(err, ErrNotFound):
+				g.Stats.PeerLoads.Add(1)
+				g.cacheNotFoundHot(key)
+			}
+			finish[j](val, err)
+			v, ok := old[i]
+			g.setLoaded(ctx, &results[i], val, err, v, ok)
+		}
+	})
+	return results
+}
+
+// setLoaded sets the result of a key of GetMany from the outcome of its
+// load. A value kept past its hard TTL, old if ok is set, is served stale
+// in place of a failed load, as loadOrStale does.
+func (g *Group) setLoaded(ctx context.Context, res *Result, val interface{}, err error, old ByteView, ok bool) {
+	switch {
+	case err == nil:
+		res.Value = val.(loadResult).value
+	case !ok || errors.Is(err, ErrNotFound) || ctx.Err() != nil:
+		res.Err = err
+	default:
+		res.Value = g.serveStale(res.Key, old, err)
+	}
+}
+
+// SetMany stores several values like Set, and returns their results in
+// the order of their keys. The values of keys owned by other peers are
+// sent in one request per peer, all peers in parallel.
+func (g *Group) SetMany(ctx context.Context, values map[string][]byte) []Result {
+	return g.addMany(ctx, values, 0)
+}
+
+// addMany is SetMany with the values expiring after ttl, or after the
+// group's default TTL if ttl is 0.
+func (g *Group) addMany(ctx context.Context, values map[string][]byte, ttl time.Duration) []Result {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	results := newResults(keys)
+	g.forEachOwner(keys, func(i int) {
+		results[i].Err = g.Add(ctx, keys[i], ByteView{b: cloneBytes(values[keys[i]])}, ttl, false)
+	}, func(peer PeerGetter, idx []int) {
+		reqs := make([]*pb.Request, len(idx))
+		for j, i := range idx {
+			// Drop the copy a Get of the key left here.
+			g.hotCache.remove(keys[i])
+			reqs[j] = &pb.Request{
+				Group: g.name,
+				Key:   keys[i],
+				Value: values[keys[i]],
+				TtlMs: int64(ttl / time.Millisecond),
+			}
+		}
+		res, err := g.sendBatch(ctx, peer, msetPath, reqs)
+		for j, i := range idx {
+			if err != nil {
+				results[i].Err = err
+			} else {
+				results[i].Err = resultErr(res[j].Error)
+			}
+		}
+		if err != nil {
+			log.Println("[GeeCache] Failed to update peer", err)
+		}
+	})
+	return results
+}
+
+// DeleteMany deletes several keys like Delete, and returns their results
+// in the order of keys. The keys owned by other peers are deleted with
+// one request per peer, all peers in parallel.
+func (g *Group) DeleteMany(ctx context.Context, keys []string) []Result {
+	results := newResults(keys)
+	g.forEachOwner(keys, func(i int) {
+		n, err := g.Delete(ctx, keys[i], false)
+		results[i].Deleted, results[i].Err = n > 0, err
+	}, func(peer PeerGetter, idx []int) {
+		reqs := make([]*pb.Request, len(idx))
+		for j, i := range idx {
+			results[i].Deleted = g.mainCache.remove(keys[i])
+			g.hotCache.remove(keys[i])
+			reqs[j] = &pb.Request{Group: g.name, Key: keys[i]}
+		}
+		res, err := g.sendBatch(ctx, peer, mdeletePath, reqs)
+		if err != nil {
+			log.Println("[GeeCache] Failed to delete from peer", err)
+			for _, i := range idx {
+				results[i].Err = err
+			}
+			return
+		}
+		for j, i := range idx {
+			results[i].Deleted = results[i].Deleted || res[j].Deleted
+			results[i].Err = resultErr(res[j].Error)
+		}
+	})
+	return results
+}
+
+// newResults returns a Result for every key.
+func newResults(keys []string) []Result {
+	results := make([]Result, len(keys))
+	for i, key := range keys {
+		results[i].Key = key
+	}
+	return results
+}
+
+// forEachOwner splits keys by owner and runs remote with the indexes of
+// the keys of every other peer, all peers in parallel, and local with the
+// index of every key this peer owns, batchParallelism keys at a time. The
+// keys of a replicated group are all run locally, as Get, Add and Delete
+// see to their replicas.
+func (g *Group) forEachOwner(keys []string, local func(i int), remote func(peer PeerGetter, idx []int)) {
+	var wg sync.WaitGroup
+	byPeer := make(map[PeerGetter][]int)
+	var own []int
+	for i, key := range keys {
+		if g.peers != nil && g.replication == nil && key != "" {
+			if peer, ok := g.peers.PickPeer(key); ok {
+				byPeer[peer] = append(byPeer[peer], i)
+				continue
+			}
+		}
+		own = append(own, i)
+	}
+	for peer, idx := range byPeer {
+		wg.Add(1)
+		go func(peer PeerGetter, idx []int) {
+			defer wg.Done()
+			remote(peer, idx)
+		}(peer, idx)
+	}
+	runParallel(len(own), func(j int) {
+		local(own[j])
+	})
+	wg.Wait()
+}
+
+// runParallel runs fn(i) for every i in [0, n), batchParallelism at a
+// time, and waits for them all.
+func runParallel(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchParallelism)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// sendBatch sends reqs to peer, in one request if it is a
+// BatchPeerGetter, and returns a result for every request. op is one of
+// mgetPath, msetPath and mdeletePath.
+func (g *Group) sendBatch(ctx context.Context, peer PeerGetter, op string, reqs []*pb.Request) ([]*pb.Result, error) {
+	in := &pb.BatchRequest{Requests: reqs}
+	bp, ok := peer.(BatchPeerGetter)
+	if !ok {
+		return sendOneByOne(ctx, peer, op, in).Results, nil
+	}
+	g.Stats.PeerBatches.Add(1)
+	var (
+		out *pb.BatchResponse
+		err error
+	)
+	switch op {
+	case mgetPath:
+		out, err = bp.GetMany(ctx, in)
+	case msetPath:
+		out, err = bp.SetMany(ctx, in)
+	case mdeletePath:
+		out, err = bp.DeleteMany(ctx, in)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Results) != len(reqs) {
+		return nil, fmt.Errorf("peer answered %d results for %d requests", len(out.Results), len(reqs))
+	}
+	return out.Results, nil
+}
+
+// sendOneByOne sends the requests of in to a peer that takes no batches,
+// one at a time.
+func sendOneByOne(ctx context.Context, peer PeerGetter, op string, in *pb.BatchRequest) *pb.BatchResponse {
+	out := &pb.BatchResponse{Results: make([]*pb.Result, len(in.Requests))}
+	for i, req := range in.Requests {
+		res := &pb.Result{Key: req.Key}
+		var err error
+		switch op {
+		case mgetPath:
+			value := &pb.Response{}
+			if err = peer.Get(ctx, req, value); err == nil {
+				res.Value, res.Version, res.Stale = value.Value, value.Version, value.Stale
+			}
+		case msetPath:
+			err = peer.Set(ctx, req)
+		case mdeletePath:
+			res.Deleted, err = peer.Delete(ctx, req)
+		}
+		if err != nil {
+			res.Error = resultError(err)
+		}
+		out.Results[i] = res
+	}
+	return out
+}
+
+// resultError is the error text of a batch result. A missing key gets
+// ErrNotFound's own text, for resultErr to tell it from other errors.
+func resultError(err error) string {
+	if errors.Is(err, ErrNotFound) {
+		return ErrNotFound.Error()
+	}
+	return err.Error()
+}
+
+// resultErr is the error of a batch result's error text.
+func resultErr(s string) error {
+	switch s {
+	case "":
+		return nil
+	case ErrNotFound.Error():
+		return ErrNotFound
+	}
+	return errors.New(s)
+}
+
+// jsonResult is the JSON form of a Result.
+type jsonResult struct {
+	Value   *string `json:"value,omitempty"`
+	Stale   bool    `json:"stale,omitempty"`
+	Deleted *bool   `json:"deleted,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// serveBatch serves the batch API at mgetPath, msetPath and mdeletePath,
+// parts being the request path split like in serveHTTP:
+//
+//	POST /_mget[/<group>]              get the keys of a JSON array
+//	POST /_mset[/<group>][?ttl=30s]    store the keys of a JSON object
+//	POST /_mdelete[/<group>]           delete the keys of a JSON array
+//
+// It answers a JSON object holding a result for every key, e.g.
+// {"Tom": {"value": "630"}, "Sam": {"error": "geecache: key not found"}}.
+// A stale value has "stale": true, and the answer then has the stale
+// header too.
+// Peers send a protobuf BatchRequest instead, whose requests name their
+// own groups, and get a BatchResponse.
+func (p *HTTPPool) serveBatch(w http.ResponseWriter, r *http.Request, parts []string, local bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	op := parts[0]
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if isContentType(r.Header, protobufContentType) {
+		in := &pb.BatchRequest{}
+		if err := proto.Unmarshal(body, in); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, err := proto.Marshal(p.runBatch(r.Context(), op, in))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", protobufContentType)
+		w.Write(body)
+		return
+	}
+
+	groupName := ""
+	if len(parts) == 2 {
+		groupName = parts[1]
+	}
+	group := p.group(w, groupName)
+	if group == nil {
+		return
+	}
+	var results []Result
+	if op == msetPath {
+		ttl, ok := parseTTL(w, r)
+		if !ok {
+			return
+		}
+		var data map[string]string
+		if err := json.Unmarshal(body, &data); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		values := make(map[string][]byte, len(data))
+		for key, value := range data {
+			values[key] = []byte(value)
+		}
+		results = group.addMany(r.Context(), values, ttl)
+	} else {
+		var keys []string
+		if err := json.Unmarshal(body, &keys); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if op == mgetPath {
+			results = group.GetMany(r.Context(), keys)
+		} else {
+			results = group.DeleteMany(r.Context(), keys)
+		}
+	}
+
+	out := make(map[string]jsonResult, len(results))
+	for _, res := range results {
+		var jr jsonResult
+		switch {
+		case res.Err != nil:
+			jr.Error = resultError(res.Err)
+		case op == mgetPath:
+			value := res.Value.String()
+			jr.Value = &value
+			if jr.Stale = res.Value.stale; jr.Stale {
+				w.Header().Set(staleHeader, "true")
+			}
+		case op == mdeletePath:
+			deleted := res.Deleted
+			jr.Deleted = &deleted
+		}
+		out[res.Key] = jr
+	}
+	body, err = json.Marshal(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// runBatch runs the requests of a batch sent by a peer, in parallel with
+// runRequests, each on its own group like servePeer does. A failed request
+// fails only its own result.
+func (p *HTTPPool) runBatch(ctx context.Context, op string, in *pb.BatchRequest) *pb.BatchResponse {
+	out := &pb.BatchResponse{Results: make([]*pb.Result, len(in.Requests))}
+	runRequests(in.Requests, func(i int) {
+		req := in.Requests[i]
+		res := &pb.Result{Key: req.Key}
+		out.Results[i] = res
+		group := p.lookupGroup(req.Group)
+		if group == nil {
+			res.Error = "no such group: " + req.Group
+			return
+		}
+		var err error
+		switch op {
+		case mgetPath:
+			var out *pb.Response
+			if out, _, err = group.servePeerGet(ctx, req); err == nil {
+				res.Value, res.Version, res.Stale = out.Value, out.Version, out.Stale
+			}
+		case msetPath:
+			err = group.servePeerSet(ctx, req)
+		case mdeletePath:
+			res.Deleted, err = group.servePeerDelete(ctx, req)
+		}
+		if err != nil {
+			res.Error = resultError(err)
+		}
+	})
+	return out
+}
+
+// runRequests runs fn(i) for every request of reqs, batchParallelism
+// keys at a time, and waits for them all. The requests of the same key
+// run one after another, in their order.
+func runRequests(reqs []*pb.Request, fn func(i int)) {
+	lane := make(map[[2]string]int)
+	var lanes [][]int
+	for i, req := range reqs {
+		k := [2]string{req.Group, req.Key}
+		l, ok := lane[k]
+		if !ok {
+			l = len(lanes)
+			lane[k] = l
+			lanes = append(lanes, nil)
+		}
+		lanes[l] = append(lanes[l], i)
+	}
+	runParallel(len(lanes), func(l int) {
+		for _, i := range lanes[l] {
+			fn(i)
+		}
+	})
+}
+
+// GetMany gets several keys from the peer in one request.
+func (h *httpGetter) GetMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	defer h.observe("get_many", time.Now())
+	return h.batch(ctx, mgetPath, in)
+}
+
+// SetMany stores several keys on the peer in one request.
+func (h *httpGetter) SetMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	defer h.observe("set_many", time.Now())
+	return h.batch(ctx, msetPath, in)
+}
+
+// DeleteMany deletes several keys from the peer in one request.
+func (h *httpGetter) DeleteMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	defer h.observe("delete_many", time.Now())
+	return h.batch(ctx, mdeletePath, in)
+}
+
+// batch posts in to the peer's batch API at path.
+func (h *httpGetter) batch(ctx context.Context, path string, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return nil, fmt.Errorf("encoding request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.baseURL+path+"?local=true", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", protobufContentType)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned: %v", res.Status)
+	}
+	body, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %v", err)
+	}
+	out := &pb.BatchResponse{}
+	if err := proto.Unmarshal(body, out); err != nil {
+		return nil, fmt.Errorf("decoding response body: %v", err)
+	}
+	return out, nil
+}
+
+var _ BatchPeerGetter = (*httpGetter)(nil)
@@ -0,0 +1,378 @@
+package geecache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	pb "geecache/geecachepb"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// batchGetter loads "db <key>", but reports keys starting with "missing"
+// as missing.
+var batchGetter = GetterFunc(func(ctx context.Context, key string) ([]byte, error) {
+	if strings.HasPrefix(key, "missing") {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return []byte("db " + key), nil
+})
+
+// remoteOwners returns the number of peers other than g's own owning
+// some of keys.
+func remoteOwners(g *Group, keys []string) int {
+	owners := make(map[PeerGetter]bool)
+	for _, key := range keys {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			owners[peer] = true
+		}
+	}
+	return len(owners)
+}
+
+func TestGetMany(t *testing.T) {
+	groups, _, stop := newTestCluster(3, "get-many", batchGetter)
+	defer stop()
+	ctx := context.Background()
+
+	keys := []string{"missing"}
+	for i := 0; i < 30; i++ {
+		keys = append(keys, fmt.Sprint("k", i))
+	}
+	results := groups[0].GetMany(ctx, keys)
+	if len(results) != len(keys) {
+		t.Fatalf("GetMany returned %d results for %d keys", len(results), len(keys))
+	}
+	for i, res := range results {
+		switch {
+		case res.Key != keys[i]:
+			t.Errorf("result %d is for %q, want %q", i, res.Key, keys[i])
+		case i == 0 && !errors.Is(res.Err, ErrNotFound):
+			t.Errorf("missing key: err %v, want ErrNotFound", res.Err)
+		case i > 0 && (res.Err != nil || res.Value.String() != "db "+res.Key):
+			t.Errorf("%s = %q, %v", res.Key, res.Value.String(), res.Err)
+		}
+	}
+	if got, want := groups[0].Stats.PeerBatches.Get(), int64(remoteOwners(groups[0], keys)); got != want {
+		t.Errorf("PeerBatches = %d, want one per owner, %d", got, want)
+	}
+}
+
+func TestGetManyHonorsTTLs(t *testing.T) {
+	groups, _, stop := newTestCluster(2, "get-many-ttl", batchGetter)
+	defer stop()
+	var keys []string
+	for i := 0; len(keys) < 2; i++ {
+		if _, ok := groups[0].peers.PickPeer(fmt.Sprint(i)); ok {
+			keys = append(keys, fmt.Sprint(i))
+		}
+	}
+	// Copies left in the main cache of a peer not owning the keys: one
+	// past its hard TTL, one past its soft TTL only.
+	now := time.Now()
+	groups[0].mainCache.add(keys[0], ByteView{b: []byte("old"), expires: now.Add(-time.Second)}, time.Hour)
+	groups[0].mainCache.add(keys[1], ByteView{b: []byte("old"), fresh: now.Add(-time.Second), expires: now.Add(time.Hour)}, time.Hour)
+
+	results := groups[0].GetMany(context.Background(), keys)
+	if res := results[0]; res.Err != nil || res.Value.String() != "db "+keys[0] {
+		t.Errorf("GetMany of an expired copy = %q, %v; want the owner's value", res.Value.String(), res.Err)
+	}
+	if res := results[1]; res.Err != nil || res.Value.String() != "old" || !res.Value.Stale() {
+		t.Errorf("GetMany past the soft TTL = %q, stale %t, %v; want old, stale", res.Value.String(), res.Value.Stale(), res.Err)
+	}
+}
+
+func TestGetManyStale(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	defer close(release)
+	groups, pools, stop := newTestCluster(2, "get-many-stale", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			if atomic.AddInt32(&calls, 1) > 1 {
+				<-release // the refresh, kept from ending
+			}
+			return []byte("v"), nil
+		}), WithSoftTTL(50*time.Millisecond), WithHotCache(HotCacheConfig{Bytes: 1 << 20, AdmitRate: 1}))
+	defer stop()
+	ctx := context.Background()
+	key := remoteKey(groups[0])
+	if _, err := groups[1].Get(ctx, key, false); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	res := groups[0].GetMany(ctx, []string{key})[0]
+	if res.Err != nil || res.Value.String() != "v" || !res.Value.Stale() {
+		t.Errorf("GetMany = %q, stale %t, %v; want v, stale", res.Value.String(), res.Value.Stale(), res.Err)
+	}
+	if n := groups[0].CacheStats(HotCache).Items; n != 0 {
+		t.Errorf("%d stale values admitted to the hot cache", n)
+	}
+
+	r, err := http.Post(pools[0].self+"/_mget/get-many-stale", "application/json", strings.NewReader(`["`+key+`"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	var out map[string]jsonResult
+	if err := json.NewDecoder(r.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !out[key].Stale || r.Header.Get(staleHeader) != "true" {
+		t.Errorf("_mget = %+v, %s %q; want stale", out[key], staleHeader, r.Header.Get(staleHeader))
+	}
+}
+
+func TestBatchRunsInParallel(t *testing.T) {
+	const n = 4
+	var running int32
+	all := make(chan struct{})
+	groups, _, stop := newTestCluster(2, "batch-parallel", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			if atomic.AddInt32(&running, 1) == n {
+				close(all)
+			}
+			// Every load waits for the others, which a serial batch never
+			// runs.
+			select {
+			case <-all:
+				return []byte("db " + key), nil
+			case <-time.After(5 * time.Second):
+				return nil, fmt.Errorf("%s loaded alone", key)
+			}
+		}))
+	defer stop()
+
+	var keys []string
+	for i := 0; len(keys) < n; i++ {
+		if _, ok := groups[0].peers.PickPeer(fmt.Sprint(i)); ok {
+			keys = append(keys, fmt.Sprint(i))
+		}
+	}
+	for _, res := range groups[0].GetMany(context.Background(), keys) {
+		if res.Err != nil {
+			t.Errorf("GetMany %s: %v", res.Key, res.Err)
+		}
+	}
+}
+
+func TestGetManyBoundsLoads(t *testing.T) {
+	var running, most int32
+	g := NewGroup("get-many-bound", 2<<10, GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for m := atomic.LoadInt32(&most); n > m; m = atomic.LoadInt32(&most) {
+				if atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return []byte("db " + key), nil
+		}))
+	var keys []string
+	for i := 0; i < 10*batchParallelism; i++ {
+		keys = append(keys, fmt.Sprint(i))
+	}
+	for _, res := range g.GetMany(context.Background(), keys) {
+		if res.Err != nil {
+			t.Errorf("GetMany %s: %v", res.Key, res.Err)
+		}
+	}
+	if most := atomic.LoadInt32(&most); most > batchParallelism {
+		t.Errorf("%d loads ran at once, want at most %d", most, batchParallelism)
+	}
+}
+
+func TestGetManyJoinsLoads(t *testing.T) {
+	var calls int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	groups, _, stop := newTestCluster(2, "get-many-join", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			return []byte("db " + key), nil
+		}))
+	defer stop()
+	key := remoteKey(groups[0])
+
+	gets := make(chan error, 1)
+	go func() {
+		_, err := groups[0].Get(context.Background(), key, false)
+		gets <- err
+	}()
+	<-started
+	// GetMany waits for the Get in flight rather than asking the owner again.
+	parked := make(chan struct{}, 1)
+	results := make(chan []Result, 1)
+	go func() {
+		ctx := &parkedContext{Context: context.Background(), parked: parked}
+		results <- groups[0].GetMany(ctx, []string{key})
+	}()
+	<-parked
+	close(release)
+	if err := <-gets; err != nil {
+		t.Fatal(err)
+	}
+	if res := (<-results)[0]; res.Err != nil || res.Value.String() != "db "+key {
+		t.Errorf("GetMany = %q, %v", res.Value.String(), res.Err)
+	}
+	if n := groups[1].Stats.ServerRequests.Get(); n != 1 {
+		t.Errorf("owner asked %d times, want 1", n)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("getter called %d times, want 1", n)
+	}
+}
+
+func TestBatchVersions(t *testing.T) {
+	groups, _, stop := newTestCluster(2, "batch-versions", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}))
+	defer stop()
+	key := remoteKey(groups[0])
+	groups[1].takeReplica(key, ByteView{b: []byte("v"), version: 42}, 0)
+
+	peer, _ := groups[0].peers.PickPeer(key)
+	reqs := []*pb.Request{{Group: groups[0].name, Key: key}}
+	res, err := groups[0].sendBatch(context.Background(), peer, mgetPath, reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Version != 42 {
+		t.Errorf("batch result version = %d, want 42", res[0].Version)
+	}
+	if res := groups[0].GetMany(context.Background(), []string{key}); res[0].Value.version != 42 {
+		t.Errorf("GetMany version = %d, want 42", res[0].Value.version)
+	}
+}
+
+func TestSetManyDeleteMany(t *testing.T) {
+	store := newFakeStore()
+	groups, _, stop := newTestCluster(3, "set-many", store)
+	defer stop()
+	ctx := context.Background()
+
+	values := make(map[string][]byte)
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint("k", i)
+		values[key] = []byte(fmt.Sprint("v", i))
+		keys = append(keys, key)
+	}
+	for _, res := range groups[0].SetMany(ctx, values) {
+		if res.Err != nil {
+			t.Errorf("SetMany %s: %v", res.Key, res.Err)
+		}
+	}
+	if n := store.writeCount(); n != len(values) {
+		t.Errorf("store got %d writes, want %d", n, len(values))
+	}
+	for _, res := range groups[1].GetMany(ctx, keys) {
+		if res.Err != nil || !bytes.Equal(res.Value.ByteSlice(), values[res.Key]) {
+			t.Errorf("GetMany after SetMany: %s = %q, %v", res.Key, res.Value.String(), res.Err)
+		}
+	}
+
+	for _, res := range groups[2].DeleteMany(ctx, keys) {
+		if res.Err != nil || !res.Deleted {
+			t.Errorf("DeleteMany %s: deleted %t, err %v", res.Key, res.Deleted, res.Err)
+		}
+	}
+	for _, key := range keys {
+		if _, ok := store.get(key); ok {
+			t.Errorf("store still has %s after DeleteMany", key)
+		}
+	}
+	for _, res := range groups[2].DeleteMany(ctx, keys) {
+		if res.Deleted {
+			t.Errorf("second DeleteMany deleted %s", res.Key)
+		}
+	}
+}
+
+func TestBatchHTTP(t *testing.T) {
+	_, pools, stop := newTestCluster(2, "batch-http", batchGetter)
+	defer stop()
+
+	post := func(path, body string) map[string]jsonResult {
+		t.Helper()
+		res, err := http.Post(pools[0].self+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("POST %s: %v %s", path, res.Status, b)
+		}
+		var out map[string]jsonResult
+		if err := json.Unmarshal(b, &out); err != nil {
+			t.Fatalf("POST %s answered %s: %v", path, b, err)
+		}
+		return out
+	}
+
+	out := post("/_mset/batch-http", `{"a": "1", "b": "2"}`)
+	if len(out) != 2 || out["a"].Error != "" || out["b"].Error != "" {
+		t.Errorf("_mset = %+v", out)
+	}
+	out = post("/_mget/batch-http", `["a", "b", "c", "missing"]`)
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "db c"} {
+		if v := out[key].Value; v == nil || *v != want {
+			t.Errorf("_mget %s = %+v, want %q", key, out[key], want)
+		}
+	}
+	if out["missing"].Error != ErrNotFound.Error() {
+		t.Errorf("_mget missing = %+v, want %q", out["missing"], ErrNotFound.Error())
+	}
+	out = post("/_mdelete/batch-http", `["a", "missing"]`)
+	if d := out["a"].Deleted; d == nil || !*d {
+		t.Errorf("_mdelete a = %+v, want deleted", out["a"])
+	}
+	if d := out["missing"].Deleted; d == nil || *d {
+		t.Errorf("_mdelete missing = %+v, want not deleted", out["missing"])
+	}
+
+	res, err := http.Post(pools[0].self+"/_mget/no-such-group", "application/json", strings.NewReader(`["a"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("_mget of unknown group: status %v, want 404", res.Status)
+	}
+}
+
+func TestGRPCGetMany(t *testing.T) {
+	groups, _, stop := newTestGRPCCluster(t, 3, "grpc-get-many", batchGetter)
+	defer stop()
+
+	keys := []string{"missing"}
+	for i := 0; i < 30; i++ {
+		keys = append(keys, fmt.Sprint("k", i))
+	}
+	for i, res := range groups[0].GetMany(context.Background(), keys) {
+		if i == 0 && !errors.Is(res.Err, ErrNotFound) {
+			t.Errorf("missing key: err %v, want ErrNotFound", res.Err)
+		}
+		if i > 0 && (res.Err != nil || res.Value.String() != "db "+res.Key) {
+			t.Errorf("%s = %q, %v", res.Key, res.Value.String(), res.Err)
+		}
+	}
+	if got, want := groups[0].Stats.PeerBatches.Get(), int64(remoteOwners(groups[0], keys)); got != want {
+		t.Errorf("PeerBatches = %d, want one per owner, %d", got, want)
+	}
+}
@@ -1,8 +1,22 @@
 package geecache
 
+import "time"
+
 // A ByteView holds an immutable view of bytes.
 type ByteView struct {
 	b []byte
+	// version orders the writes of a replicated key, see WithReplication
+	version int64
+	// notFound marks a negative entry, a key the Getter reported missing
+	notFound bool
+	// fresh and expires are the soft and hard deadlines of a cached value,
+	// zero for none, see WithSoftTTL
+	fresh, expires time.Time
+	// stale marks a value answered past its soft or hard deadline
+	stale bool
+	// delta is how long the Getter took to load the value, see
+	// WithEarlyRefresh
+	delta time.Duration
 }
 
 // Len returns the view's length
@@ -20,6 +34,24 @@ func (v ByteView) String() string {
 	return string(v.b)
 }
 
+// pastSoftTTL reports whether the value is stale at t but may be served.
+func (v ByteView) pastSoftTTL(t time.Time) bool {
+	return !v.fresh.IsZero() && !t.Before(v.fresh)
+}
+
+// expired reports whether the value is past its hard TTL at t, kept only
+// to be served if reloading it fails.
+func (v ByteView) expired(t time.Time) bool {
+	return !v.expires.IsZero() && !t.Before(v.expires)
+}
+
+// Stale reports whether the value was answered past its soft TTL, while
+// it is reloaded, or past its hard TTL, because reloading it failed. See
+// WithSoftTTL and WithStaleOnError.
+func (v ByteView) Stale() bool {
+	return v.stale
+}
+
 func cloneBytes(b []byte) []byte {
 	c := make([]byte, len(b))
 	copy(c, b)
@@ -3,46 +3,174 @@ package geecache
 import (
 	//"fmt"
 	"geecache/lru"
-	"log"
 	"sync"
+	"time"
 )
 
+// sweepInterval is how often add reclaims expired entries.
+const sweepInterval = time.Minute
+
 type cache struct {
 	mu         sync.Mutex
-	lru        *lru.Cache
+	policy     Policy
+	newPolicy  PolicyFunc // LRU if nil
 	cacheBytes int64
+	lastSweep  time.Time
+	nget, nhit int64
+	// nstale counts the gets that found an entry past its hard TTL, kept
+	// to be served if reloading it fails
+	nstale int64
+	// nevict counts the evictions of each lru.EvictReason
+	nevict [3]int64
+}
+
+func (c *cache) onEvicted(key string, value lru.Value, reason lru.EvictReason) {
+	c.nevict[reason]++
+}
+
+// evictions returns the number of evictions of each lru.EvictReason.
+func (c *cache) evictions() [3]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nevict
+}
+
+func (c *cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CacheStats{
+		Gets:      c.nget,
+		Hits:      c.nhit,
+		Stale:     c.nstale,
+		Evictions: c.nevict[lru.EvictCapacity] + c.nevict[lru.EvictExpired],
+	}
+	if c.policy != nil {
+		s.Bytes = c.policy.Bytes()
+		s.Items = int64(c.policy.Len())
+	}
+	return s
+}
+
+// init creates the policy on first use. c.mu must be held.
+func (c *cache) init() {
+	if c.policy == nil {
+		if c.newPolicy == nil {
+			c.newPolicy = LRU
+		}
+		c.policy = c.newPolicy(c.cacheBytes, c.onEvicted)
+		c.lastSweep = time.Now()
+	}
 }
 
-func (c *cache) add(key string, value ByteView) {
+// add stores the value, which expires after ttl if ttl > 0.
+// Expired entries are swept at most once per sweepInterval, amortized
+// over the adds.
+func (c *cache) add(key string, value ByteView, ttl time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lru == nil {
-		c.lru = lru.New(c.cacheBytes, nil)
+	c.init()
+	c.policy.AddWithTTL(key, value, ttl)
+	if time.Since(c.lastSweep) >= sweepInterval {
+		c.policy.RemoveExpired()
+		c.lastSweep = time.Now()
 	}
-	c.lru.Add(key, value)
 }
 
 func (c *cache) get(key string) (value ByteView, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lru == nil {
+	c.nget++
+	if c.policy == nil {
 		return
 	}
 
-	if v, ok := c.lru.Get(key); ok {
+	if v, ok := c.policy.Get(key); ok {
+		if v.(ByteView).expired(time.Now()) {
+			c.nstale++
+		} else {
+			c.nhit++
+		}
 		return v.(ByteView), ok
 	}
 
 	return
 }
 
-func (c *cache) remove(key string) int {
+// remove removes key and reports whether it held a value, a negative
+// entry not counting.
+func (c *cache) remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.policy == nil {
+		return false
+	}
+	v, ok := c.policy.Peek(key)
+	if !ok {
+		return false
+	}
+	c.policy.Remove(key)
+	return !v.(ByteView).notFound
+}
+
+// addIfAbsent is like add but keeps the value already cached under key,
+// if any. It reports whether value was added.
+func (c *cache) addIfAbsent(key string, value ByteView, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	if _, ok := c.policy.Peek(key); ok {
+		return false
+	}
+	c.policy.AddWithTTL(key, value, ttl)
+	return true
+}
+
+// addIfNewer is like add but keeps the value already cached under key if
+// it has a newer version. It reports whether value was added.
+func (c *cache) addIfNewer(key string, value ByteView, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	if v, ok := c.policy.Peek(key); ok && v.(ByteView).version > value.version {
+		return false
+	}
+	c.policy.AddWithTTL(key, value, ttl)
+	return true
+}
+
+// removeIfOlder replaces the value cached under key with tombstone, a
+// versioned negative entry, unless the value has a newer version. It
+// reports whether a value was removed, a negative entry not counting.
+func (c *cache) removeIfOlder(key string, tombstone ByteView, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	v, ok := c.policy.Peek(key)
+	if ok && v.(ByteView).version > tombstone.version {
+		return false
+	}
+	c.policy.AddWithTTL(key, tombstone, ttl)
+	return ok && !v.(ByteView).notFound
+}
+
+// cacheEntry is a cached value with the time it has left, 0 for ever.
+type cacheEntry struct {
+	key   string
+	value ByteView
+	ttl   time.Duration
+}
+
+// entries returns a snapshot of the unexpired entries.
+func (c *cache) entries() []cacheEntry {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.lru == nil {
-		return 0
+	if c.policy == nil {
+		return nil
 	}
-	returnCount := c.lru.Remove(key)
-	log.Printf("returncount is %d", returnCount)
-	return returnCount
+	entries := make([]cacheEntry, 0, c.policy.Len())
+	c.policy.Range(func(key string, value lru.Value, ttl time.Duration) bool {
+		entries = append(entries, cacheEntry{key, value.(ByteView), ttl})
+		return true
+	})
+	return entries
 }
@@ -2,10 +2,8 @@ package consistenthash
 
 import (
 	"hash/crc32"
-	"log"
 	"sort"
 	"strconv"
-	"strings"
 )
 
 // Hash maps bytes to uint32
@@ -44,6 +42,31 @@ func (m *Map) Add(keys ...string) {
 	sort.Ints(m.keys)
 }
 
+// Remove removes some keys from the hash.
+func (m *Map) Remove(keys ...string) {
+	removed := false
+	for _, key := range keys {
+		for i := 0; i < m.replicas; i++ {
+			hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
+			// A colliding replica of another key stays.
+			if m.hashMap[hash] == key {
+				delete(m.hashMap, hash)
+				removed = true
+			}
+		}
+	}
+	if !removed {
+		return
+	}
+	kept := m.keys[:0]
+	for _, hash := range m.keys {
+		if _, ok := m.hashMap[hash]; ok {
+			kept = append(kept, hash)
+		}
+	}
+	m.keys = kept
+}
+
 // GetforKey gets the closest item in the hash to the provided key.
 func (m *Map) GetforKey(key string) string {
 	if len(m.keys) == 0 {
@@ -59,20 +82,29 @@ func (m *Map) GetforKey(key string) string {
 	return m.hashMap[m.keys[idx%len(m.keys)]]
 }
 
-// Get gets items from peer
-func (m *Map) Get(peeraddr string) (string, string) {
-	// 使用 strings.LastIndex 查找最后一个冒号 (:) 的位置
-	colonIndex := strings.LastIndex(peeraddr, ":")
-
-	// 获取冒号之后的子串，即端口号
-	nowport := ""
-	if colonIndex != -1 && colonIndex < len(peeraddr)-1 {
-		nowport = peeraddr[colonIndex+1:]
+// GetN gets the n distinct items closest to the provided key going round
+// the hash, starting with the one GetforKey returns. Fewer are returned
+// when the hash holds fewer items.
+func (m *Map) GetN(key string, n int) []string {
+	if len(m.keys) == 0 || n <= 0 {
+		return nil
 	}
 
-	log.Println("now port:", nowport)
-	url := peeraddr + "/"
-	//peer := &httpGetter{baseURL: url}
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
 
-	return url, nowport
+	items := make([]string, 0, n)
+	for i := 0; i < len(m.keys) && len(items) < n; i++ {
+		item := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		seen := false
+		for _, it := range items {
+			seen = seen || it == item
+		}
+		if !seen {
+			items = append(items, item)
+		}
+	}
+	return items
 }
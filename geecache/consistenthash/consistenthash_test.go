@@ -1,6 +1,7 @@
 package consistenthash
 
 import (
+	"fmt"
 	"strconv"
 	"testing"
 )
@@ -41,3 +42,66 @@ func TestHashing(t *testing.T) {
 	}
 
 }
+
+func TestRemove(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	hash.Add("6", "4", "2", "8")
+
+	// Removes 8, 18, 28: 27 falls back to 2.
+	hash.Remove("8")
+	for k, v := range map[string]string{"2": "2", "11": "2", "23": "4", "27": "2"} {
+		if hash.GetforKey(k) != v {
+			t.Errorf("Asking for %s, should have yielded %s", k, v)
+		}
+	}
+	if len(hash.keys) != 9 {
+		t.Errorf("%d replicas left, want 9", len(hash.keys))
+	}
+
+	hash.Remove("9") // not in the hash
+	hash.Remove("6", "4", "2")
+	if got := hash.GetforKey("11"); got != "" {
+		t.Errorf("empty hash yielded %q", got)
+	}
+
+	// Removing a key keeps the replica it shares with another key.
+	hash = New(1, func(key []byte) uint32 { return 7 })
+	hash.Add("a", "b")
+	hash.Remove("a")
+	if got := hash.GetforKey("x"); got != "b" {
+		t.Errorf("after removing a, got %q, want b", got)
+	}
+}
+
+func TestGetN(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	// Replicas 2, 4, 6, 12, 14, 16, 22, 24, 26.
+	hash.Add("6", "4", "2")
+
+	testCases := []struct {
+		key  string
+		n    int
+		want string
+	}{
+		{"11", 1, "[2]"},
+		{"11", 2, "[2 4]"},
+		{"23", 3, "[4 6 2]"},
+		{"27", 2, "[2 4]"},
+		{"3", 5, "[4 6 2]"}, // only three items
+		{"3", 0, "[]"},
+	}
+	for _, tc := range testCases {
+		if got := fmt.Sprint(hash.GetN(tc.key, tc.n)); got != tc.want {
+			t.Errorf("GetN(%s, %d) = %s, want %s", tc.key, tc.n, got, tc.want)
+		}
+	}
+	if got := New(3, nil).GetN("x", 2); got != nil {
+		t.Errorf("empty hash yielded %v", got)
+	}
+}
@@ -1,53 +1,94 @@
 package geecache
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	pb "geecache/geecachepb"
+	"geecache/metrics"
 	"geecache/singleflight"
 	"log"
-	"strconv"
-
-	//"strings"
 	"sync"
+	"time"
 )
 
-var addrMap = map[int]string{
-	9527: "http://cache-server-1:9527",
-	9528: "http://cache-server-2:9528",
-	9529: "http://cache-server-3:9529",
-}
-
-type Request struct {
-	Group string
-	Key   string
-}
-
-type Response struct {
-	Value []byte
-}
-
 // A Group is a cache namespace and associated data loaded spread over
 type Group struct {
 	name      string
 	getter    Getter
 	mainCache cache
-	peers     PeerPicker
+	// hotCache holds values owned by other peers, if hot is set by
+	// WithHotCache
+	hotCache cache
+	hot      *HotCacheConfig
+	peers    PeerPicker
 	// use singleflight.Group to make sure that each key is only fetched once
 	loader *singleflight.Group
-	// Determine if the most recent Get was a local get
-	localGet bool
+	// ttl is the default lifetime of cached values, zero means forever
+	ttl time.Duration
+	// negativeTTL is the lifetime of negative entries, zero turns them off
+	negativeTTL time.Duration
+	// softTTL and staleOnError are set by WithSoftTTL and WithStaleOnError,
+	// refreshing then holds the keys being refreshed
+	softTTL      time.Duration
+	staleOnError time.Duration
+	refreshing   sync.Map
+	// earlyRefresh is the beta of WithEarlyRefresh, zero for none
+	earlyRefresh float64
+	// setter, deleter and batchWriter are the getter's, if it implements them
+	setter      Setter
+	deleter     Deleter
+	batchWriter BatchWriter
+	// writeBehind is set by WithWriteBehind, queue then holds the writes
+	writeBehind *WriteBehind
+	queue       *writeQueue
+	// replication is set by WithReplication, replicaLoader then
+	// deduplicates the reads of replicas
+	replication   *Replication
+	replicaLoader *singleflight.Group
+
+	// Stats are statistics on the group.
+	Stats Stats
+	// getterDuration records the latency of the Getter
+	getterDuration *metrics.Histogram
+}
+
+// A GroupOption configures a Group in NewGroup.
+type GroupOption func(*Group)
+
+// WithTTL sets the default lifetime of the values cached by the group.
+func WithTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.ttl = ttl
+	}
 }
 
+// ErrNotFound is returned by Get for a key that does not exist.
+var ErrNotFound = errors.New("geecache: key not found")
+
 // A Getter loads data for a key.
+// It should give up once ctx is done.
+// It should return an error wrapping ErrNotFound if the key does not
+// exist, which is cached for a while, see WithNegativeTTL. Other errors
+// are taken as transient and never cached.
 type Getter interface {
-	Get(key string) ([]byte, error)
+	Get(ctx context.Context, key string) ([]byte, error)
 }
 
 // A GetterFunc implements Getter with a function.
-type GetterFunc func(key string) ([]byte, error)
+type GetterFunc func(ctx context.Context, key string) ([]byte, error)
 
 // Get implements Getter interface function
-func (f GetterFunc) Get(key string) ([]byte, error) {
+func (f GetterFunc) Get(ctx context.Context, key string) ([]byte, error) {
+	return f(ctx, key)
+}
+
+// A SimpleGetterFunc implements Getter with a function that takes no
+// context, for getters that cannot be cancelled.
+type SimpleGetterFunc func(key string) ([]byte, error)
+
+// Get implements Getter interface function, ignoring ctx
+func (f SimpleGetterFunc) Get(ctx context.Context, key string) ([]byte, error) {
 	return f(key)
 }
 
@@ -57,7 +98,7 @@ var (
 )
 
 // NewGroup create a new instance of Group
-func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
+func NewGroup(name string, cacheBytes int64, getter Getter, opts ...GroupOption) *Group {
 	if getter == nil {
 		panic("nil Getter")
 	}
@@ -68,6 +109,21 @@ func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
 		getter:    getter,
 		mainCache: cache{cacheBytes: cacheBytes},
 		loader:    &singleflight.Group{},
+
+		negativeTTL: defaultNegativeTTL,
+
+		replicaLoader: &singleflight.Group{},
+
+		getterDuration: metrics.NewHistogram(metrics.DefBuckets),
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	g.setter, _ = getter.(Setter)
+	g.deleter, _ = getter.(Deleter)
+	g.batchWriter, _ = getter.(BatchWriter)
+	if g.writeBehind != nil && (g.setter != nil || g.deleter != nil) {
+		g.queue = newWriteQueue(g, *g.writeBehind)
 	}
 	groups[name] = g
 	return g
@@ -88,190 +144,343 @@ func (g *Group) RegisterPeers(peers PeerPicker) {
 		panic("RegisterPeerPicker called more than once")
 	}
 	g.peers = peers
+	if r, ok := peers.(groupRegistrar); ok {
+		r.registerGroup(g)
+	}
 }
 
-// Get value for a key from cache
-// If the key is not in the cache, use load to find in other port
-func (g *Group) Get(key string, port string, loacl bool) (ByteView, error, string) {
-	if key == "" {
-		return ByteView{}, fmt.Errorf("key is required"), port
-	}
+// groupRegistrar is implemented by a PeerPicker that serves the groups
+// registered with it, such as HTTPPool.
+type groupRegistrar interface {
+	registerGroup(g *Group)
+}
 
-	if v, ok := g.mainCache.get(key); ok {
-		g.localGet = true
-		//log.Println("[GeeCache] hit")
-		log.Println("[GeeCache] hit", "Key:", key, "Value:", v)
-		return v, nil, port
+// A Source tells where a Get found its value.
+type Source int
+
+const (
+	// FromCache means the value was in this peer's cache.
+	FromCache Source = iota
+	// FromPeer means the value was loaded from the key's owner.
+	FromPeer
+	// FromGetter means the value was loaded with the group's Getter.
+	FromGetter
+)
+
+func (s Source) String() string {
+	switch s {
+	case FromCache:
+		return "cache"
+	case FromPeer:
+		return "peer"
+	case FromGetter:
+		return "getter"
 	}
+	return "unknown"
+}
 
-	// After this, the commands are not issued. Change localGet to false.
-	g.localGet = false
-	log.Println("load begining")
-	return g.Getload(key, port, loacl)
+// Get value for a key from cache
+// If the key is not in the cache, use load to ask the key's owner
+func (g *Group) Get(ctx context.Context, key string, local bool) (ByteView, error) {
+	v, _, err := g.GetWithSource(ctx, key, local)
+	return v, err
 }
 
-// Delete a key from local cache
-// If the key is not in the cache, use Deleteload to find in other port
-func (g *Group) Delete(key string, port string, local bool) int {
-	if g.mainCache.lru == nil {
-		return 0
+// GetWithSource is like Get and also tells where the value came from.
+func (g *Group) GetWithSource(ctx context.Context, key string, local bool) (ByteView, Source, error) {
+	g.Stats.Gets.Add(1)
+	if local {
+		g.Stats.ServerRequests.Add(1)
 	}
-	if deleted := g.mainCache.remove(key); deleted != 0 {
-		return 1
+	if key == "" {
+		return ByteView{}, FromCache, fmt.Errorf("key is required")
 	}
-	deletedCount := 0
-	log.Printf("deletedCount is %d, local is %t", deletedCount, local)
-	if deletedCount == 0 && !local {
-		log.Println("deleteload begining")
-		deletedCount = g.Deleteload(key, port, local)
+
+	var replicas []PeerGetter
+	if !local {
+		replicas = g.replicas(key)
+	}
+	if replicas != nil && g.replication.R > 1 {
+		// The other replicas are read even when the key is cached here.
+		return g.getReplicated(ctx, key, replicas)
+	}
+	v, hit, ok := g.lookupCache(key, local)
+	if hit {
+		return g.cacheHit(v)
+	}
+	if replicas != nil {
+		return g.getReplicated(ctx, key, replicas)
 	}
 
-	return deletedCount
+	log.Println("load begining")
+	return g.loadOrStale(ctx, key, local, v, ok)
 }
 
-// Check if the key is cacahed on other ports before Add
-// Use Updateload to upadte the key if the key is cache on other ports
-func (g *Group) Add(key string, value ByteView, port string, local bool, jsonData string) {
-	log.Printf("get from other peer to make sure")
-	_, err, portnum := g.Get(key, port, local)
-
-	//the key is found on other ports.
-	if err == nil && !g.localGet {
-		// Change localGet to true, Prevent program deadlock
-		g.localGet = true
-		log.Printf("the key has already existed and Upadate value in this port : %s", portnum)
-		err := g.Updateload(portnum, jsonData)
-		if err != nil {
-			return
+// lookupCache looks key up in the caches as Get does. hit is set if the
+// value found answers Get: a value of the main cache that has not
+// expired, marked stale and refreshed in the background past its soft
+// TTL, or else, unless local is set, a value of the hot cache. Otherwise
+// ok tells whether the main cache still has a value kept past its hard
+// TTL, for loadOrStale.
+func (g *Group) lookupCache(key string, local bool) (v ByteView, hit, ok bool) {
+	v, ok = g.mainCache.get(key)
+	if now := time.Now(); ok && !v.expired(now) {
+		log.Println("[GeeCache] hit", "Key:", key, "Value:", v)
+		if v.pastSoftTTL(now) {
+			g.Stats.StaleHits.Add(1)
+			g.refresh(key)
+			v.stale = true
+		} else if g.refreshEarly(v, now) && g.refresh(key) {
+			g.Stats.EarlyRefreshes.Add(1)
+		}
+		return v, true, true
+	}
+	if !local {
+		if hv, hot := g.getHot(key); hot {
+			return hv, true, true
 		}
-		//group.Add(key, ByteView{b: []byte(strVal)})
-		return
 	}
-	g.mainCache.add(key, value)
+	return v, false, ok
 }
 
-// Get key from other ports
-// If there is a local identifier, Getload is not executed
-// the local identifier indicates that the request was sent from another port.
-func (g *Group) Getload(key string, port string, local bool) (value ByteView, err error, portnum string) {
-	var ErrNotFound = errors.New("key not found")
-	if local {
-		return ByteView{}, ErrNotFound, port
+// Delete a key from local cache
+// If the key is owned by another peer, the delete is forwarded to it as well
+// Otherwise the key is deleted from the group's Deleter, if any.
+// An error is returned if the owner or the Deleter failed, the key is then
+// not counted as deleted.
+func (g *Group) Delete(ctx context.Context, key string, local bool) (int, error) {
+	deletedCount := 0
+	if g.mainCache.remove(key) {
+		deletedCount = 1
 	}
-
-	if g.peers != nil {
-		for _, peeraddr := range addrMap {
-			// Converts string to int
-			portInt, err := strconv.Atoi(port)
-			if addrMap[portInt] == peeraddr {
-				fmt.Println("Port:", port, "Mapped Address:", addrMap[portInt])
-				continue
+	g.hotCache.remove(key)
+	log.Printf("deletedCount is %d, local is %t", deletedCount, local)
+	if !local {
+		if replicas := g.replicas(key); replicas != nil {
+			n, err := g.deleteReplicated(ctx, key, replicas)
+			if err != nil {
+				return 0, err
 			}
-			_, nowport, nowpeer := g.peers.PickPeer(peeraddr)
-			log.Printf("Selected another peer: %s, port: %s", nowpeer, nowport)
-			peer := &httpGetter{baseURL: nowpeer}
-			if value, err = g.getFromPeer(peer, key); err == nil {
-				//portnum := port
-				log.Printf("Get key in %s", nowport)
-				return value, nil, nowport
+			if n > 0 {
+				deletedCount = 1
 			}
-			log.Println("[GeeCache] Failed to get from peer", err)
+			return deletedCount, nil
 		}
-
 	}
+	if !local && g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			log.Println("delete from owner peer")
+			deleted, err := g.deleFromPeer(ctx, peer, key)
+			if err != nil {
+				log.Println("[GeeCache] Failed to delete from peer", err)
+				return 0, err
+			}
+			if deleted {
+				deletedCount = 1
+			}
+			return deletedCount, nil
+		}
+	}
+	if err := g.storeDelete(ctx, key); err != nil {
+		log.Println("[GeeCache] Failed to delete from the store", err)
+		return 0, err
+	}
+	return deletedCount, nil
+}
 
-	return g.getLocally(key, port)
+// Set stores value under key on the key's owner, without loading the key
+// first. The value expires after the group's default TTL. An error is
+// returned if the owner could not store it.
+func (g *Group) Set(ctx context.Context, key string, value []byte) error {
+	return g.Add(ctx, key, ByteView{b: cloneBytes(value)}, 0, false)
 }
 
-// Delete key from other ports
-// If there is a local identifier, Deleteload is not executed
-// the local identifier indicates that the request was sent from another port.
-func (g *Group) Deleteload(key string, port string, local bool) int {
-	if local {
-		return 0
+// Add stores the value on the key's owner.
+// The value expires after ttl, or after the group's default TTL if ttl is 0.
+// If the owner is another peer, the value is sent there with setOnPeer
+// and an error is returned if that fails. With local set the value is
+// stored on this peer, as peers do for the values sent to them.
+// A replicated group stores the value on the key's replicas instead, see
+// WithReplication.
+func (g *Group) Add(ctx context.Context, key string, value ByteView, ttl time.Duration, local bool) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
 	}
-	log.Printf("delete from other peer")
-	if g.peers != nil {
-		for _, peeraddr := range addrMap {
-			portInt, err := strconv.Atoi(port)
-			if err != nil {
-				log.Printf("Error converting port '%s': %v", port, err)
-				continue // 跳过当前迭代
+	g.hotCache.remove(key)
+	if !local {
+		if replicas := g.replicas(key); replicas != nil {
+			return g.addReplicated(ctx, key, value, ttl, replicas)
+		}
+	}
+	if !local && g.peers != nil {
+		if peer, ok := g.peers.PickPeer(key); ok {
+			if err := g.setOnPeer(ctx, peer, key, value, ttl, false); err != nil {
+				log.Println("[GeeCache] Failed to update peer", err)
+				return err
 			}
-			//fmt.Println("Port:", port, "Mapped Address:", addrMap[portInt])
-			if addrMap[portInt] == peeraddr {
-				fmt.Println("Port:", port, "Mapped Address:", addrMap[portInt])
-				continue
+			return nil
+		}
+	}
+	if err := g.storeSet(ctx, key, value); err != nil {
+		return err
+	}
+	if ttl == 0 {
+		ttl = g.ttl
+	}
+	value, ttl = g.stamp(value, ttl)
+	g.mainCache.add(key, value, ttl)
+	return nil
+}
+
+// load fetches the key from its owner, or from the local getter when this
+// peer is the owner.
+// If there is a local identifier, the owner is not asked again: the local
+// identifier indicates that the request was sent from another port.
+// Concurrent loads of the same key are deduplicated with singleflight,
+// so the peer or the getter is asked once, with the context of the first
+// caller. The other callers stop waiting when their own ctx is done.
+func (g *Group) load(ctx context.Context, key string, local bool) (value ByteView, source Source, err error) {
+	g.Stats.Loads.Add(1)
+	for {
+		resulti, err := g.loader.DoContext(ctx, key, func() (interface{}, error) {
+			g.Stats.LoadsDeduped.Add(1)
+			if !local && g.peers != nil {
+				if peer, ok := g.peers.PickPeer(key); ok {
+					value, err := g.getFromPeer(ctx, peer, key, false)
+					if err == nil {
+						g.Stats.PeerLoads.Add(1)
+						if !value.stale {
+							g.admitHot(key, value)
+						}
+						return loadResult{value, FromPeer}, nil
+					}
+					if errors.Is(err, ErrNotFound) {
+						// The owner's answer stands, the getter is not asked.
+						g.Stats.PeerLoads.Add(1)
+						g.cacheNotFoundHot(key)
+						return nil, err
+					}
+					g.Stats.PeerErrors.Add(1)
+					if ctx.Err() != nil {
+						return nil, ctx.Err()
+					}
+					log.Println("[GeeCache] Failed to get from peer", err)
+				}
 			}
 
-			_, nowport, nowpeer := g.peers.PickPeer(peeraddr)
-			log.Printf("Selected another peer: %s, port: %s", nowpeer, nowport)
-			peer := &httpGetter{baseURL: nowpeer}
-			log.Println("Selected another peer:", peer)
-			if deleted := g.deleFromPeer(peer, key); deleted {
-				return 1
+			return g.loadLocal(ctx, key)
+		})
+		if err == nil {
+			result := resulti.(loadResult)
+			return result.value, result.source, nil
+		}
+		if err == singleflight.ErrLeaderGone {
+			if ctx.Err() == nil {
+				// The caller that ran the load went away, but this one did not.
+				continue
 			}
+			err = ctx.Err()
 		}
+		return ByteView{}, FromCache, err
+	}
+}
+
+// loadLocal loads key with the Getter for a singleflight load.
+func (g *Group) loadLocal(ctx context.Context, key string) (interface{}, error) {
+	value, err := g.getLocally(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		g.Stats.LocalNotFound.Add(1)
+		return nil, err
 	}
-	return 0
+	if err != nil {
+		g.Stats.LocalLoadErrs.Add(1)
+		return nil, err
+	}
+	g.Stats.LocalLoads.Add(1)
+	return loadResult{value, FromGetter}, nil
 }
 
-// Update keys on other ports
-func (g *Group) Updateload(port string, jsondate string) error {
-	portInt, _ := strconv.Atoi(port)
-	peeraddr := addrMap[portInt]
-	peer := &httpGetter{baseURL: peeraddr}
-	err := g.updateToPeer(peer, jsondate)
-	return err
+// loadResult is what a singleflight load hands to every waiter.
+type loadResult struct {
+	value  ByteView
+	source Source
 }
 
 /**
- * The methods getFromPeer, deleFromPeer, and updateToPeer leverage functions get, delete,
+ * The methods getFromPeer, deleFromPeer, and setOnPeer leverage functions get, delete,
  * and update defined in the PeerGetter interface.
  * These methods facilitate GET, DELETE, and UPDATE operations on a peer node within the distributed network architecture.
  */
 
-func (g *Group) getFromPeer(peer PeerGetter, key string) (ByteView, error) {
-	log.Println("getfrompeer Selected peer:", peer)
-	req := &Request{
-		Group: g.name,
-		Key:   key,
+func (g *Group) getFromPeer(ctx context.Context, peer PeerGetter, key string, replica bool) (ByteView, error) {
+	req := &pb.Request{
+		Group:   g.name,
+		Key:     key,
+		Replica: replica,
+	}
+	res := &pb.Response{}
+	err := peer.Get(ctx, req, res)
+	if errors.Is(err, ErrNotFound) {
+		// A tombstone's version comes with the answer.
+		return ByteView{notFound: true, version: res.Version}, err
 	}
-	res := &Response{}
-	err := peer.Get(req, res)
 	if err != nil {
 		return ByteView{}, err
 	}
-	return ByteView{b: res.Value}, nil
+	return ByteView{b: res.Value, version: res.Version, stale: res.Stale}, nil
 }
 
-func (g *Group) deleFromPeer(peer PeerGetter, key string) bool {
-	log.Println("getfrompeer Selected peer:", peer)
-	req := &Request{
+func (g *Group) deleFromPeer(ctx context.Context, peer PeerGetter, key string) (bool, error) {
+	req := &pb.Request{
 		Group: g.name,
 		Key:   key,
 	}
-	return peer.Delete(req)
+	return peer.Delete(ctx, req)
 }
 
-func (g *Group) updateToPeer(peer PeerGetter, data string) error {
-	req := &Request{}
-	return peer.Update(req, data)
+func (g *Group) setOnPeer(ctx context.Context, peer PeerGetter, key string, value ByteView, ttl time.Duration, replica bool) error {
+	req := &pb.Request{
+		Group:   g.name,
+		Key:     key,
+		Value:   value.ByteSlice(),
+		TtlMs:   int64(ttl / time.Millisecond),
+		Replica: replica,
+		Version: value.version,
+	}
+	return peer.Set(ctx, req)
 }
 
 // Search in locally configured database
-func (g *Group) getLocally(key string, port string) (ByteView, error, string) {
-	log.Printf("From %s getting local", port)
-	bytes, err := g.getter.Get(key)
+func (g *Group) getLocally(ctx context.Context, key string) (ByteView, error) {
+	if g.queue != nil {
+		// The store is behind a pending write.
+		if b, deleted, ok := g.queue.lookup(key); ok {
+			if deleted {
+				g.cacheNotFound(key)
+				return ByteView{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+			}
+			value := ByteView{b: b}
+			g.populateCache(key, value)
+			return value, nil
+		}
+	}
+	start := time.Now()
+	bytes, err := g.getter.Get(ctx, key)
+	delta := time.Since(start)
+	g.getterDuration.Observe(delta.Seconds())
+	if errors.Is(err, ErrNotFound) {
+		g.cacheNotFound(key)
+	}
 	if err != nil {
-		return ByteView{}, err, port
+		return ByteView{}, err
 
 	}
-	value := ByteView{b: cloneBytes(bytes)}
+	value := ByteView{b: cloneBytes(bytes), delta: delta}
 	g.populateCache(key, value)
-	return value, nil, port
+	return value, nil
 }
 
 func (g *Group) populateCache(key string, value ByteView) {
-	g.mainCache.add(key, value)
+	value, ttl := g.stamp(value, g.ttl)
+	g.mainCache.add(key, value, ttl)
 }
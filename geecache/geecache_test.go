@@ -0,0 +1,310 @@
+package geecache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCluster starts n in-process nodes talking over HTTP. Each node
+// serves its own group called name. It returns the groups, in the same
+// order as their pools, and a function stopping the nodes.
+func newTestCluster(n int, name string, getter Getter, opts ...GroupOption) ([]*Group, []*HTTPPool, func()) {
+	return newWrappedCluster(n, name, getter, nil, opts...)
+}
+
+// newWrappedCluster is newTestCluster with the pool of node i served
+// through wrap(i, pool), if wrap is set.
+func newWrappedCluster(n int, name string, getter Getter, wrap func(int, http.Handler) http.Handler, opts ...GroupOption) ([]*Group, []*HTTPPool, func()) {
+	servers := make([]*httptest.Server, n)
+	pools := make([]*HTTPPool, n)
+	addrs := make([]string, n)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		addrs[i] = "http://" + servers[i].Listener.Addr().String()
+		pools[i] = NewHTTPPool(addrs[i])
+		servers[i].Config.Handler = pools[i]
+		if wrap != nil {
+			servers[i].Config.Handler = wrap(i, pools[i])
+		}
+		servers[i].Start()
+	}
+	groups := make([]*Group, n)
+	for i, pool := range pools {
+		pool.Set(addrs...)
+		groups[i] = NewGroup(name, 2<<20, getter, opts...)
+		groups[i].RegisterPeers(pool)
+	}
+	return groups, pools, func() {
+		for _, s := range servers {
+			s.Close()
+		}
+	}
+}
+
+// remoteKey returns a key that g forwards to a peer.
+func remoteKey(g *Group) string {
+	for i := 0; ; i++ {
+		if _, ok := g.peers.PickPeer(fmt.Sprint(i)); ok {
+			return fmt.Sprint(i)
+		}
+	}
+}
+
+// parkedContext tells on parked the first time Done is called on it. The
+// singleflight group only calls Done on the context of a duplicate caller
+// waiting for the call in flight.
+type parkedContext struct {
+	context.Context
+	parked chan<- struct{}
+	once   sync.Once
+}
+
+func (c *parkedContext) Done() <-chan struct{} {
+	c.once.Do(func() { c.parked <- struct{}{} })
+	return c.Context.Done()
+}
+
+func TestGetDeduplicatesLoads(t *testing.T) {
+	var calls int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	g := NewGroup("dedup", 2<<10, GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			return []byte("value of " + key), nil
+		}))
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	parked := make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := &parkedContext{Context: context.Background(), parked: parked}
+			v, err := g.Get(ctx, "key", false)
+			if err == nil && v.String() != "value of key" {
+				err = fmt.Errorf("got %q", v.String())
+			}
+			errs <- err
+		}()
+	}
+	// Hold the getter until it is running and every other Get waits for
+	// its result inside the singleflight group.
+	<-started
+	for i := 0; i < n-1; i++ {
+		<-parked
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("getter called %d times, expect 1", calls)
+	}
+}
+
+// TestConcurrentGetAddDelete runs a mixed workload on a two node cluster,
+// it is meant to be run with -race.
+func TestConcurrentGetAddDelete(t *testing.T) {
+	groups, _, stop := newTestCluster(2, "concurrent", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return []byte("db " + key), nil
+		}))
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for j := 0; j < 100; j++ {
+				g := groups[r.Intn(len(groups))]
+				key := fmt.Sprintf("key%d", r.Intn(10))
+				switch r.Intn(3) {
+				case 0:
+					if _, err := g.Get(context.Background(), key, false); err != nil {
+						t.Errorf("Get(%s): %v", key, err)
+					}
+				case 1:
+					if err := g.Add(context.Background(), key, ByteView{b: []byte("set " + key)}, 0, false); err != nil {
+						t.Errorf("Add(%s): %v", key, err)
+					}
+				case 2:
+					g.Delete(context.Background(), key, false)
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	// Every node must now agree on a freshly written value.
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := groups[0].Add(context.Background(), key, ByteView{b: []byte("final")}, 0, false); err != nil {
+			t.Fatal(err)
+		}
+		for _, g := range groups {
+			if v, err := g.Get(context.Background(), key, false); err != nil || v.String() != "final" {
+				t.Fatalf("Get(%s) = %q, %v, expect final", key, v.String(), err)
+			}
+		}
+	}
+}
+
+func TestGetWithSource(t *testing.T) {
+	groups, _, stop := newTestCluster(2, "source", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return []byte("db " + key), nil
+		}))
+	defer stop()
+
+	// Find a key owned by the second node.
+	key := ""
+	for i := 0; key == ""; i++ {
+		if _, ok := groups[0].peers.PickPeer(fmt.Sprint(i)); ok {
+			key = fmt.Sprint(i)
+		}
+	}
+	if _, source, err := groups[0].GetWithSource(context.Background(), key, false); err != nil || source != FromPeer {
+		t.Fatalf("first Get from non-owner: source %v, err %v", source, err)
+	}
+	if _, source, err := groups[1].GetWithSource(context.Background(), key, false); err != nil || source != FromCache {
+		t.Fatalf("Get from owner after load: source %v, err %v", source, err)
+	}
+}
+
+func TestGetCancelsPeerLoad(t *testing.T) {
+	cancelled := make(chan struct{})
+	groups, _, stop := newTestCluster(2, "cancel", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}))
+	defer stop()
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if _, ok := groups[0].peers.PickPeer(fmt.Sprint(i)); ok {
+			key = fmt.Sprint(i)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := groups[0].Get(ctx, key, false); err == nil {
+		t.Fatal("Get should fail once its context is done")
+	}
+	// The owner's getter must see the request go away.
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the owner's getter was not cancelled")
+	}
+}
+
+func TestGetterTimeoutNotRetried(t *testing.T) {
+	var calls int32
+	g := NewGroup("getter-timeout", 2<<10, GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, context.DeadlineExceeded
+		}))
+	if _, err := g.Get(context.Background(), "k", false); err != context.DeadlineExceeded {
+		t.Errorf("Get: err %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("getter called %d times, want 1", n)
+	}
+}
+
+func TestSimpleGetterFunc(t *testing.T) {
+	g := NewGroup("simple", 2<<10, SimpleGetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("db " + key), nil
+		}))
+	if v, err := g.Get(context.Background(), "Tom", false); err != nil || v.String() != "db Tom" {
+		t.Fatalf("Get = %q, %v", v.String(), err)
+	}
+}
+
+func TestAddBinaryValueThroughPeer(t *testing.T) {
+	groups, _, stop := newTestCluster(2, "binary", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s not found", key)
+		}))
+	defer stop()
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if _, ok := groups[0].peers.PickPeer(fmt.Sprint(i)); ok {
+			key = fmt.Sprint(i)
+		}
+	}
+	value := []byte{0, 0xff, '"', '\n', 0x80}
+	if err := groups[0].Add(context.Background(), key, ByteView{b: value}, time.Minute, false); err != nil {
+		t.Fatalf("Add through peer: %v", err)
+	}
+	view, source, err := groups[0].GetWithSource(context.Background(), key, false)
+	if err != nil || source != FromPeer {
+		t.Fatalf("Get from non-owner: source %v, err %v", source, err)
+	}
+	if !bytes.Equal(view.ByteSlice(), value) {
+		t.Fatalf("Get = %q, want %q", view.ByteSlice(), value)
+	}
+}
+
+func TestSet(t *testing.T) {
+	var loads int32
+	groups, _, stop := newTestCluster(2, "set", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			atomic.AddInt32(&loads, 1)
+			return []byte("db " + key), nil
+		}))
+	defer stop()
+	ctx := context.Background()
+
+	key := remoteKey(groups[0])
+	value := []byte("v1")
+	if err := groups[0].Set(ctx, key, value); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	value[0] = 'x' // Set keeps its own copy
+	if n := atomic.LoadInt32(&loads); n != 0 {
+		t.Fatalf("Set loaded the key %d times, want 0", n)
+	}
+	if _, ok := groups[0].mainCache.get(key); ok {
+		t.Errorf("non-owner cached the value it forwarded")
+	}
+	if view, ok := groups[1].mainCache.get(key); !ok || view.String() != "v1" {
+		t.Errorf("owner cache = %q, %v; want v1", view.String(), ok)
+	}
+
+	if err := groups[0].Set(ctx, "", value); err == nil {
+		t.Errorf("Set of empty key succeeded")
+	}
+	stop()
+	if err := groups[0].Set(ctx, key, value); err == nil {
+		t.Errorf("Set with the owner down succeeded")
+	}
+}
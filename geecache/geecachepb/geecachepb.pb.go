@@ -4,8 +4,12 @@
 package geecachepb
 
 import (
+	context "context"
 	fmt "fmt"
 	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
 	math "math"
 )
 
@@ -21,8 +25,23 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 type Request struct {
-	Group                string   `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
-	Key                  string   `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Group string `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	Key   string `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	// value and ttl_ms are only set when storing a key
+	Value []byte `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"`
+	TtlMs int64  `protobuf:"varint,4,opt,name=ttl_ms,json=ttlMs,proto3" json:"ttl_ms,omitempty"`
+	// handoff marks a value sent on by the key's previous owner after the
+	// ring changed. It is cached by the new owner but not written to the
+	// group's store, which has it already.
+	Handoff bool `protobuf:"varint,5,opt,name=handoff,proto3" json:"handoff,omitempty"`
+	// replica marks a write or delete of a key's replica that is not the
+	// owner, which only updates the cache. The owner updates the store.
+	Replica bool `protobuf:"varint,6,opt,name=replica,proto3" json:"replica,omitempty"`
+	// version orders the writes of a replicated key, the newest wins.
+	Version int64 `protobuf:"varint,7,opt,name=version,proto3" json:"version,omitempty"`
+	// fresh_ms is the time a handed off value has left before it goes
+	// stale, negative if it is stale already and 0 if it never does.
+	FreshMs              int64    `protobuf:"varint,8,opt,name=fresh_ms,json=freshMs,proto3" json:"fresh_ms,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -67,8 +86,55 @@ func (m *Request) GetKey() string {
 	return ""
 }
 
+func (m *Request) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *Request) GetTtlMs() int64 {
+	if m != nil {
+		return m.TtlMs
+	}
+	return 0
+}
+
+func (m *Request) GetHandoff() bool {
+	if m != nil {
+		return m.Handoff
+	}
+	return false
+}
+
+func (m *Request) GetReplica() bool {
+	if m != nil {
+		return m.Replica
+	}
+	return false
+}
+
+func (m *Request) GetVersion() int64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *Request) GetFreshMs() int64 {
+	if m != nil {
+		return m.FreshMs
+	}
+	return 0
+}
+
 type Response struct {
-	Value                []byte   `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	Value []byte `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	// version is the version of a replicated value, 0 if it was loaded
+	// rather than written.
+	Version int64 `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	// stale marks a value answered past its soft or hard TTL.
+	Stale                bool     `protobuf:"varint,3,opt,name=stale,proto3" json:"stale,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -106,23 +172,554 @@ func (m *Response) GetValue() []byte {
 	return nil
 }
 
+func (m *Response) GetVersion() int64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *Response) GetStale() bool {
+	if m != nil {
+		return m.Stale
+	}
+	return false
+}
+
+type DeleteResponse struct {
+	Deleted              bool     `protobuf:"varint,1,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeleteResponse) Reset()         { *m = DeleteResponse{} }
+func (m *DeleteResponse) String() string { return proto.CompactTextString(m) }
+func (*DeleteResponse) ProtoMessage()    {}
+func (*DeleteResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_889d0a4ad37a0d42, []int{2}
+}
+
+func (m *DeleteResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeleteResponse.Unmarshal(m, b)
+}
+func (m *DeleteResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeleteResponse.Marshal(b, m, deterministic)
+}
+func (m *DeleteResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeleteResponse.Merge(m, src)
+}
+func (m *DeleteResponse) XXX_Size() int {
+	return xxx_messageInfo_DeleteResponse.Size(m)
+}
+func (m *DeleteResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeleteResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeleteResponse proto.InternalMessageInfo
+
+func (m *DeleteResponse) GetDeleted() bool {
+	if m != nil {
+		return m.Deleted
+	}
+	return false
+}
+
+type SetResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SetResponse) Reset()         { *m = SetResponse{} }
+func (m *SetResponse) String() string { return proto.CompactTextString(m) }
+func (*SetResponse) ProtoMessage()    {}
+func (*SetResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_889d0a4ad37a0d42, []int{3}
+}
+
+func (m *SetResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SetResponse.Unmarshal(m, b)
+}
+func (m *SetResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SetResponse.Marshal(b, m, deterministic)
+}
+func (m *SetResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SetResponse.Merge(m, src)
+}
+func (m *SetResponse) XXX_Size() int {
+	return xxx_messageInfo_SetResponse.Size(m)
+}
+func (m *SetResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_SetResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SetResponse proto.InternalMessageInfo
+
+// BatchRequest carries several requests to the same peer. Every request
+// names its own group.
+type BatchRequest struct {
+	Requests             []*Request `protobuf:"bytes,1,rep,name=requests,proto3" json:"requests,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
+}
+
+func (m *BatchRequest) Reset()         { *m = BatchRequest{} }
+func (m *BatchRequest) String() string { return proto.CompactTextString(m) }
+func (*BatchRequest) ProtoMessage()    {}
+func (*BatchRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_889d0a4ad37a0d42, []int{4}
+}
+
+func (m *BatchRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BatchRequest.Unmarshal(m, b)
+}
+func (m *BatchRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BatchRequest.Marshal(b, m, deterministic)
+}
+func (m *BatchRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BatchRequest.Merge(m, src)
+}
+func (m *BatchRequest) XXX_Size() int {
+	return xxx_messageInfo_BatchRequest.Size(m)
+}
+func (m *BatchRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_BatchRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BatchRequest proto.InternalMessageInfo
+
+func (m *BatchRequest) GetRequests() []*Request {
+	if m != nil {
+		return m.Requests
+	}
+	return nil
+}
+
+// Result is the outcome for one request of a batch. error is empty on
+// success.
+type Result struct {
+	Key     string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value   []byte `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	Deleted bool   `protobuf:"varint,3,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	Error   string `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	// stale marks a value answered past its soft or hard TTL.
+	Stale bool `protobuf:"varint,5,opt,name=stale,proto3" json:"stale,omitempty"`
+	// version is the version of a replicated value, see Response.
+	Version              int64    `protobuf:"varint,6,opt,name=version,proto3" json:"version,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Result) Reset()         { *m = Result{} }
+func (m *Result) String() string { return proto.CompactTextString(m) }
+func (*Result) ProtoMessage()    {}
+func (*Result) Descriptor() ([]byte, []int) {
+	return fileDescriptor_889d0a4ad37a0d42, []int{5}
+}
+
+func (m *Result) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Result.Unmarshal(m, b)
+}
+func (m *Result) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Result.Marshal(b, m, deterministic)
+}
+func (m *Result) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Result.Merge(m, src)
+}
+func (m *Result) XXX_Size() int {
+	return xxx_messageInfo_Result.Size(m)
+}
+func (m *Result) XXX_DiscardUnknown() {
+	xxx_messageInfo_Result.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Result proto.InternalMessageInfo
+
+func (m *Result) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *Result) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *Result) GetDeleted() bool {
+	if m != nil {
+		return m.Deleted
+	}
+	return false
+}
+
+func (m *Result) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *Result) GetStale() bool {
+	if m != nil {
+		return m.Stale
+	}
+	return false
+}
+
+func (m *Result) GetVersion() int64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+// BatchResponse holds one result per request, in the order of the requests.
+type BatchResponse struct {
+	Results              []*Result `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *BatchResponse) Reset()         { *m = BatchResponse{} }
+func (m *BatchResponse) String() string { return proto.CompactTextString(m) }
+func (*BatchResponse) ProtoMessage()    {}
+func (*BatchResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_889d0a4ad37a0d42, []int{6}
+}
+
+func (m *BatchResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BatchResponse.Unmarshal(m, b)
+}
+func (m *BatchResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BatchResponse.Marshal(b, m, deterministic)
+}
+func (m *BatchResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BatchResponse.Merge(m, src)
+}
+func (m *BatchResponse) XXX_Size() int {
+	return xxx_messageInfo_BatchResponse.Size(m)
+}
+func (m *BatchResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_BatchResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BatchResponse proto.InternalMessageInfo
+
+func (m *BatchResponse) GetResults() []*Result {
+	if m != nil {
+		return m.Results
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Request)(nil), "geecachepb.Request")
 	proto.RegisterType((*Response)(nil), "geecachepb.Response")
+	proto.RegisterType((*DeleteResponse)(nil), "geecachepb.DeleteResponse")
+	proto.RegisterType((*SetResponse)(nil), "geecachepb.SetResponse")
+	proto.RegisterType((*BatchRequest)(nil), "geecachepb.BatchRequest")
+	proto.RegisterType((*Result)(nil), "geecachepb.Result")
+	proto.RegisterType((*BatchResponse)(nil), "geecachepb.BatchResponse")
 }
 
 func init() { proto.RegisterFile("geecachepb.proto", fileDescriptor_889d0a4ad37a0d42) }
 
 var fileDescriptor_889d0a4ad37a0d42 = []byte{
-	// 148 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x48, 0x4f, 0x4d, 0x4d,
-	0x4e, 0x4c, 0xce, 0x48, 0x2d, 0x48, 0xd2, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x42, 0x88,
-	0x28, 0x19, 0x72, 0xb1, 0x07, 0xa5, 0x16, 0x96, 0xa6, 0x16, 0x97, 0x08, 0x89, 0x70, 0xb1, 0xa6,
-	0x17, 0xe5, 0x97, 0x16, 0x48, 0x30, 0x2a, 0x30, 0x6a, 0x70, 0x06, 0x41, 0x38, 0x42, 0x02, 0x5c,
-	0xcc, 0xd9, 0xa9, 0x95, 0x12, 0x4c, 0x60, 0x31, 0x10, 0x53, 0x49, 0x81, 0x8b, 0x23, 0x28, 0xb5,
-	0xb8, 0x20, 0x3f, 0xaf, 0x38, 0x15, 0xa4, 0xa7, 0x2c, 0x31, 0xa7, 0x34, 0x15, 0xac, 0x87, 0x27,
-	0x08, 0xc2, 0x31, 0xb2, 0xe3, 0xe2, 0x72, 0x07, 0x69, 0x76, 0x06, 0x59, 0x22, 0x64, 0xc0, 0xc5,
-	0xec, 0x9e, 0x5a, 0x22, 0x24, 0xac, 0x87, 0xe4, 0x10, 0xa8, 0x9d, 0x52, 0x22, 0xa8, 0x82, 0x10,
-	0x53, 0x93, 0xd8, 0xc0, 0xee, 0x34, 0x06, 0x04, 0x00, 0x00, 0xff, 0xff, 0x5c, 0xd5, 0xdd, 0x09,
-	0xbb, 0x00, 0x00, 0x00,
+	// 435 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x53, 0xcb, 0x8e, 0xd3, 0x30,
+	0x14, 0x95, 0x13, 0xf2, 0x98, 0x3b, 0x33, 0x68, 0x64, 0x8a, 0xf0, 0x74, 0x15, 0x65, 0x15, 0x21,
+	0x34, 0xa0, 0x99, 0x15, 0x0b, 0x06, 0xf1, 0x90, 0xba, 0xaa, 0x84, 0xdc, 0x0f, 0x40, 0x99, 0xf4,
+	0x76, 0x52, 0x11, 0x92, 0x60, 0x3b, 0x95, 0xfa, 0x17, 0xfc, 0x15, 0xdf, 0xc3, 0x1f, 0x20, 0xc7,
+	0x71, 0xeb, 0x54, 0x61, 0x03, 0x3b, 0x9f, 0x7b, 0x8f, 0xaf, 0xcf, 0xb9, 0x27, 0x81, 0xab, 0x47,
+	0xc4, 0x22, 0x2f, 0x4a, 0x6c, 0x1f, 0x6e, 0x5a, 0xd1, 0xa8, 0x86, 0xc2, 0xb1, 0x92, 0xfe, 0x22,
+	0x10, 0x71, 0xfc, 0xd1, 0xa1, 0x54, 0x74, 0x06, 0xc1, 0xa3, 0x68, 0xba, 0x96, 0x91, 0x84, 0x64,
+	0x67, 0xdc, 0x00, 0x7a, 0x05, 0xfe, 0x37, 0xdc, 0x33, 0xaf, 0xaf, 0xe9, 0xa3, 0xe6, 0xed, 0xf2,
+	0xaa, 0x43, 0xe6, 0x27, 0x24, 0xbb, 0xe0, 0x06, 0xd0, 0xe7, 0x10, 0x2a, 0x55, 0x7d, 0xfd, 0x2e,
+	0xd9, 0x93, 0x84, 0x64, 0x3e, 0x0f, 0x94, 0xaa, 0x96, 0x92, 0x32, 0x88, 0xca, 0xbc, 0x5e, 0x37,
+	0x9b, 0x0d, 0x0b, 0x12, 0x92, 0xc5, 0xdc, 0x42, 0xdd, 0x11, 0xd8, 0x56, 0xdb, 0x22, 0x67, 0xa1,
+	0xe9, 0x0c, 0x50, 0x77, 0x76, 0x28, 0xe4, 0xb6, 0xa9, 0x59, 0xd4, 0xcf, 0xb2, 0x90, 0x5e, 0x43,
+	0xbc, 0x11, 0x28, 0x4b, 0xfd, 0x4c, 0x6c, 0x5a, 0x3d, 0x5e, 0xca, 0xf4, 0x0b, 0xc4, 0x1c, 0x65,
+	0xdb, 0xd4, 0x12, 0x8f, 0x0a, 0x89, 0xab, 0xd0, 0x19, 0xeb, 0x8d, 0xc7, 0xce, 0x20, 0x90, 0x2a,
+	0xaf, 0x8c, 0xa3, 0x98, 0x1b, 0x90, 0xbe, 0x84, 0xa7, 0x9f, 0xb1, 0x42, 0x85, 0x87, 0xb9, 0x0c,
+	0xa2, 0x75, 0x5f, 0x59, 0xf7, 0x93, 0x63, 0x6e, 0x61, 0x7a, 0x09, 0xe7, 0x2b, 0x54, 0x96, 0x98,
+	0xbe, 0x87, 0x8b, 0x8f, 0xb9, 0x2a, 0x4a, 0xbb, 0xda, 0xd7, 0x10, 0x0b, 0x73, 0x94, 0x8c, 0x24,
+	0x7e, 0x76, 0x7e, 0xfb, 0xec, 0xc6, 0xc9, 0x65, 0xa0, 0xf1, 0x03, 0x29, 0xfd, 0x49, 0x20, 0xe4,
+	0x28, 0xbb, 0x4a, 0xd9, 0x00, 0xc8, 0x44, 0x00, 0xde, 0x89, 0x3d, 0x2b, 0xce, 0x1f, 0x89, 0xd3,
+	0x7c, 0x14, 0xa2, 0x11, 0x7d, 0x32, 0x67, 0xdc, 0x80, 0xa3, 0xe9, 0xc0, 0x31, 0xed, 0x2e, 0x29,
+	0x1c, 0x2d, 0x29, 0x7d, 0x07, 0x97, 0x83, 0xa7, 0x61, 0x1b, 0xaf, 0x74, 0x80, 0x5a, 0xa2, 0xf5,
+	0x44, 0xc7, 0x9e, 0x74, 0x8b, 0x5b, 0xca, 0xed, 0x6f, 0x0f, 0x60, 0xa1, 0xbf, 0xa8, 0x4f, 0x9a,
+	0x40, 0xdf, 0x80, 0xbf, 0x40, 0x45, 0xa7, 0xd6, 0x30, 0x9f, 0x9d, 0xcc, 0x31, 0xcf, 0xbd, 0x85,
+	0xd0, 0xc4, 0x31, 0x7d, 0x69, 0xee, 0x16, 0x4f, 0x72, 0xbb, 0x03, 0x7f, 0xf5, 0xb7, 0xc7, 0x5e,
+	0xb8, 0x45, 0x27, 0x43, 0x7a, 0x0f, 0xd1, 0x02, 0xd5, 0x32, 0xaf, 0xf7, 0x94, 0xb9, 0x1c, 0x37,
+	0xd8, 0xf9, 0xf5, 0x44, 0x67, 0xb8, 0xff, 0x01, 0xc0, 0xc8, 0xf8, 0xf7, 0x11, 0xf7, 0x10, 0xad,
+	0xfe, 0x43, 0xc2, 0x43, 0xd8, 0xff, 0xf0, 0x77, 0x7f, 0x06, 0x00, 0x6b, 0xb0, 0xc4, 0x5f, 0x04,
+	0x04, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// GroupCacheClient is the client API for GroupCache service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type GroupCacheClient interface {
+	Get(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error)
+	Delete(ctx context.Context, in *Request, opts ...grpc.CallOption) (*DeleteResponse, error)
+	Set(ctx context.Context, in *Request, opts ...grpc.CallOption) (*SetResponse, error)
+	GetMany(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	DeleteMany(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	SetMany(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+}
+
+type groupCacheClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGroupCacheClient(cc grpc.ClientConnInterface) GroupCacheClient {
+	return &groupCacheClient{cc}
+}
+
+func (c *groupCacheClient) Get(ctx context.Context, in *Request, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/geecachepb.GroupCache/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *groupCacheClient) Delete(ctx context.Context, in *Request, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/geecachepb.GroupCache/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *groupCacheClient) Set(ctx context.Context, in *Request, opts ...grpc.CallOption) (*SetResponse, error) {
+	out := new(SetResponse)
+	err := c.cc.Invoke(ctx, "/geecachepb.GroupCache/Set", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *groupCacheClient) GetMany(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, "/geecachepb.GroupCache/GetMany", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *groupCacheClient) DeleteMany(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, "/geecachepb.GroupCache/DeleteMany", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *groupCacheClient) SetMany(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, "/geecachepb.GroupCache/SetMany", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GroupCacheServer is the server API for GroupCache service.
+type GroupCacheServer interface {
+	Get(context.Context, *Request) (*Response, error)
+	Delete(context.Context, *Request) (*DeleteResponse, error)
+	Set(context.Context, *Request) (*SetResponse, error)
+	GetMany(context.Context, *BatchRequest) (*BatchResponse, error)
+	DeleteMany(context.Context, *BatchRequest) (*BatchResponse, error)
+	SetMany(context.Context, *BatchRequest) (*BatchResponse, error)
+}
+
+// UnimplementedGroupCacheServer can be embedded to have forward compatible implementations.
+type UnimplementedGroupCacheServer struct {
+}
+
+func (*UnimplementedGroupCacheServer) Get(ctx context.Context, req *Request) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (*UnimplementedGroupCacheServer) Delete(ctx context.Context, req *Request) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (*UnimplementedGroupCacheServer) Set(ctx context.Context, req *Request) (*SetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Set not implemented")
+}
+func (*UnimplementedGroupCacheServer) GetMany(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMany not implemented")
+}
+func (*UnimplementedGroupCacheServer) DeleteMany(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteMany not implemented")
+}
+func (*UnimplementedGroupCacheServer) SetMany(ctx context.Context, req *BatchRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetMany not implemented")
+}
+
+func RegisterGroupCacheServer(s *grpc.Server, srv GroupCacheServer) {
+	s.RegisterService(&_GroupCache_serviceDesc, srv)
+}
+
+func _GroupCache_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GroupCacheServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/geecachepb.GroupCache/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GroupCacheServer).Get(ctx, req.(*Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GroupCache_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GroupCacheServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/geecachepb.GroupCache/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GroupCacheServer).Delete(ctx, req.(*Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GroupCache_Set_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GroupCacheServer).Set(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/geecachepb.GroupCache/Set",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GroupCacheServer).Set(ctx, req.(*Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GroupCache_GetMany_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GroupCacheServer).GetMany(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/geecachepb.GroupCache/GetMany",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GroupCacheServer).GetMany(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GroupCache_DeleteMany_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GroupCacheServer).DeleteMany(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/geecachepb.GroupCache/DeleteMany",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GroupCacheServer).DeleteMany(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _GroupCache_SetMany_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GroupCacheServer).SetMany(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/geecachepb.GroupCache/SetMany",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GroupCacheServer).SetMany(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _GroupCache_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "geecachepb.GroupCache",
+	HandlerType: (*GroupCacheServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _GroupCache_Get_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _GroupCache_Delete_Handler,
+		},
+		{
+			MethodName: "Set",
+			Handler:    _GroupCache_Set_Handler,
+		},
+		{
+			MethodName: "GetMany",
+			Handler:    _GroupCache_GetMany_Handler,
+		},
+		{
+			MethodName: "DeleteMany",
+			Handler:    _GroupCache_DeleteMany_Handler,
+		},
+		{
+			MethodName: "SetMany",
+			Handler:    _GroupCache_SetMany_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "geecachepb.proto",
 }
@@ -0,0 +1,494 @@
+// Package gossip keeps a list of live cluster members with a SWIM-style
+// protocol.
+//
+// Every protocol period a node pings one other member. If the member
+// does not answer in time, a few other members are asked to ping it on
+// the node's behalf. If none of them gets an answer either, the member is
+// suspected, and declared dead when nobody heard from it for a while.
+// A member that learns it is suspected or dead refutes it by bumping its
+// incarnation number. Every message carries the sender's whole member
+// table, which suits the small clusters of a cache.
+package gossip
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the state of a member.
+type State int
+
+const (
+	// Alive members answer pings.
+	Alive State = iota
+	// Suspect members did not answer, directly or indirectly. They are
+	// still members until they time out.
+	Suspect
+	// Dead members timed out as suspects, or left.
+	Dead
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// A Member is what a node knows about another node.
+type Member struct {
+	Addr        string `json:"addr"`
+	State       State  `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// A Message is a ping, or the answer to one. It carries the sender's
+// member table.
+type Message struct {
+	Members []Member `json:"members"`
+}
+
+// A Transport sends messages to other members.
+type Transport interface {
+	// Ping sends msg to addr and returns its answer.
+	Ping(ctx context.Context, addr string, msg *Message) (*Message, error)
+	// PingReq asks via to ping target and returns target's answer.
+	PingReq(ctx context.Context, via, target string, msg *Message) (*Message, error)
+}
+
+// Config configures a Memberlist. Zero fields take their defaults.
+type Config struct {
+	// ProbeInterval is the protocol period, 1s by default.
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long to wait for an answer to a ping, 300ms
+	// by default. Indirect pings get the rest of the protocol period.
+	ProbeTimeout time.Duration
+	// SuspectTimeout is how long a member stays suspect before it is
+	// declared dead, 3s by default.
+	SuspectTimeout time.Duration
+	// IndirectProbes is the number of members asked to ping a member
+	// that did not answer, 2 by default.
+	IndirectProbes int
+	// Transport sends the messages. It is required.
+	Transport Transport
+	// OnChange, if set, is called with the addresses of the members that
+	// are not dead, sorted and including this node, whenever they change.
+	OnChange func(members []string)
+}
+
+// Memberlist is one node's view of the cluster.
+type Memberlist struct {
+	self   string
+	config Config
+
+	mu       sync.Mutex
+	members  map[string]*member // including self
+	order    []string           // probe order, reshuffled every round
+	next     int
+	reported []string // last members passed to OnChange
+	left     bool
+	notifyMu sync.Mutex // orders the calls of OnChange
+	stop     chan struct{}
+	done     chan struct{}
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+type member struct {
+	Member
+	// changed is when the state last changed
+	changed time.Time
+}
+
+// New returns the member list of the node self, knowing about seeds.
+// Call Start to run the protocol.
+func New(self string, seeds []string, config Config) *Memberlist {
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = time.Second
+	}
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = 300 * time.Millisecond
+	}
+	if config.SuspectTimeout <= 0 {
+		config.SuspectTimeout = 3 * time.Second
+	}
+	if config.IndirectProbes <= 0 {
+		config.IndirectProbes = 2
+	}
+	m := &Memberlist{
+		self:    self,
+		config:  config,
+		members: make(map[string]*member),
+		now:     time.Now,
+	}
+	// A restarted node must win over the dead entry others keep about
+	// its previous life, so incarnations start at the clock.
+	m.members[self] = &member{
+		Member:  Member{Addr: self, State: Alive, Incarnation: uint64(time.Now().UnixNano())},
+		changed: m.now(),
+	}
+	for _, seed := range seeds {
+		if seed != self {
+			m.members[seed] = &member{Member: Member{Addr: seed, State: Alive}, changed: m.now()}
+		}
+	}
+	m.reported = m.liveLocked()
+	return m
+}
+
+// Start runs the protocol in the background until Stop or Leave.
+func (m *Memberlist) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run(m.stop, m.done)
+}
+
+// Stop stops the protocol. The other members will consider this node dead.
+func (m *Memberlist) Stop() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop = nil
+	m.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Leave tells the other members that this node leaves, then stops.
+func (m *Memberlist) Leave(ctx context.Context) {
+	m.mu.Lock()
+	m.left = true
+	me := m.members[m.self]
+	me.State = Dead
+	me.Incarnation++
+	var peers []string
+	for addr, mem := range m.members {
+		if addr != m.self && mem.State != Dead {
+			peers = append(peers, addr)
+		}
+	}
+	msg := m.messageLocked()
+	m.mu.Unlock()
+	m.Stop()
+
+	var wg sync.WaitGroup
+	for _, addr := range peers {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			m.config.Transport.Ping(ctx, addr, msg)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// Join adds addrs to the members and pings them right away.
+func (m *Memberlist) Join(addrs ...string) {
+	m.mu.Lock()
+	for _, addr := range addrs {
+		if mem, ok := m.members[addr]; !ok {
+			m.members[addr] = &member{Member: Member{Addr: addr, State: Alive}, changed: m.now()}
+		} else if mem.State == Dead {
+			// Give it a chance to answer with a newer incarnation.
+			m.setState(mem, Suspect)
+		}
+	}
+	m.mu.Unlock()
+	m.changed()
+	for _, addr := range addrs {
+		if addr != m.self {
+			go m.ping(context.Background(), addr)
+		}
+	}
+}
+
+// Members returns every known member, including this node, sorted by
+// address.
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Member, 0, len(m.members))
+	for _, mem := range m.members {
+		list = append(list, mem.Member)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
+
+// Live returns the addresses of the members that are not dead, sorted
+// and including this node.
+func (m *Memberlist) Live() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.liveLocked()
+}
+
+// HandlePing merges a received ping and returns the answer.
+func (m *Memberlist) HandlePing(msg *Message) *Message {
+	m.merge(msg)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.messageLocked()
+}
+
+// HandlePingReq merges a received ping request and pings target on the
+// sender's behalf, returning target's answer.
+func (m *Memberlist) HandlePingReq(ctx context.Context, target string, msg *Message) (*Message, error) {
+	m.merge(msg)
+	m.mu.Lock()
+	out := m.messageLocked()
+	m.mu.Unlock()
+	ack, err := m.config.Transport.Ping(ctx, target, out)
+	if err != nil {
+		return nil, err
+	}
+	m.merge(ack)
+	return ack, nil
+}
+
+func (m *Memberlist) run(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(m.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), m.config.ProbeInterval)
+		m.round(ctx)
+		cancel()
+	}
+}
+
+// round runs one protocol period: it probes the next member, gives a
+// dead member a chance to come back, and times out suspects.
+func (m *Memberlist) round(ctx context.Context) {
+	if target := m.nextTarget(); target != "" {
+		m.probe(ctx, target)
+	}
+	if dead := m.randomMember(Dead); dead != "" {
+		// ctx ends with the round, the ping outlives it.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), m.config.ProbeTimeout)
+			defer cancel()
+			m.ping(ctx, dead)
+		}()
+	}
+	m.mu.Lock()
+	now := m.now()
+	for _, mem := range m.members {
+		if mem.State == Suspect && now.Sub(mem.changed) >= m.config.SuspectTimeout {
+			log.Printf("[gossip %s] %s is dead", m.self, mem.Addr)
+			m.setState(mem, Dead)
+		}
+	}
+	m.mu.Unlock()
+	m.changed()
+}
+
+// probe pings target, then asks other members to, and suspects target
+// if nobody got an answer.
+func (m *Memberlist) probe(ctx context.Context, target string) {
+	pctx, cancel := context.WithTimeout(ctx, m.config.ProbeTimeout)
+	ok := m.ping(pctx, target)
+	cancel()
+	if ok {
+		return
+	}
+
+	m.mu.Lock()
+	var helpers []string
+	for addr, mem := range m.members {
+		if addr != m.self && addr != target && mem.State == Alive {
+			helpers = append(helpers, addr)
+		}
+	}
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > m.config.IndirectProbes {
+		helpers = helpers[:m.config.IndirectProbes]
+	}
+	msg := m.messageLocked()
+	m.mu.Unlock()
+
+	acks := make(chan bool, len(helpers))
+	for _, via := range helpers {
+		go func(via string) {
+			ack, err := m.config.Transport.PingReq(ctx, via, target, msg)
+			if err == nil {
+				m.merge(ack)
+			}
+			acks <- err == nil
+		}(via)
+	}
+	for range helpers {
+		if <-acks {
+			return
+		}
+	}
+
+	m.mu.Lock()
+	if mem := m.members[target]; mem != nil && mem.State == Alive {
+		log.Printf("[gossip %s] suspecting %s", m.self, target)
+		m.setState(mem, Suspect)
+	}
+	m.mu.Unlock()
+	m.changed()
+}
+
+// ping pings addr directly and merges the answer. It reports whether
+// addr answered.
+func (m *Memberlist) ping(ctx context.Context, addr string) bool {
+	m.mu.Lock()
+	msg := m.messageLocked()
+	m.mu.Unlock()
+	ack, err := m.config.Transport.Ping(ctx, addr, msg)
+	if err != nil {
+		return false
+	}
+	m.merge(ack)
+	return true
+}
+
+// nextTarget returns the next member to probe in a shuffled round robin
+// over the members that are not dead.
+func (m *Memberlist) nextTarget() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		for ; m.next < len(m.order); m.next++ {
+			if mem := m.members[m.order[m.next]]; mem != nil && mem.State != Dead {
+				m.next++
+				return mem.Addr
+			}
+		}
+		// Start a new round.
+		m.order = m.order[:0]
+		for addr := range m.members {
+			if addr != m.self {
+				m.order = append(m.order, addr)
+			}
+		}
+		rand.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+		m.next = 0
+	}
+	return ""
+}
+
+// randomMember returns a random member in state, or "".
+func (m *Memberlist) randomMember(state State) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var addrs []string
+	for addr, mem := range m.members {
+		if addr != m.self && mem.State == state {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[rand.Intn(len(addrs))]
+}
+
+// merge applies the member table of a received message.
+func (m *Memberlist) merge(msg *Message) {
+	if msg == nil {
+		return
+	}
+	m.mu.Lock()
+	for _, u := range msg.Members {
+		m.apply(u)
+	}
+	m.mu.Unlock()
+	m.changed()
+}
+
+// apply applies what another node knows about a member, if it is newer.
+// m.mu must be held.
+func (m *Memberlist) apply(u Member) {
+	if u.Addr == m.self {
+		me := m.members[m.self]
+		if !m.left && u.State != Alive && u.Incarnation >= me.Incarnation {
+			// Refute the rumor.
+			me.Incarnation = u.Incarnation + 1
+		}
+		return
+	}
+	cur, ok := m.members[u.Addr]
+	if !ok {
+		m.members[u.Addr] = &member{Member: u, changed: m.now()}
+		return
+	}
+	newer := u.Incarnation > cur.Incarnation ||
+		u.Incarnation == cur.Incarnation && u.State > cur.State
+	if newer {
+		cur.Incarnation = u.Incarnation
+		m.setState(cur, u.State)
+	}
+}
+
+// setState changes the state of mem. m.mu must be held.
+func (m *Memberlist) setState(mem *member, state State) {
+	if mem.State != state {
+		mem.State = state
+		mem.changed = m.now()
+	}
+}
+
+func (m *Memberlist) messageLocked() *Message {
+	msg := &Message{Members: make([]Member, 0, len(m.members))}
+	for _, mem := range m.members {
+		msg.Members = append(msg.Members, mem.Member)
+	}
+	return msg
+}
+
+func (m *Memberlist) liveLocked() []string {
+	var live []string
+	for addr, mem := range m.members {
+		if mem.State != Dead || addr == m.self {
+			live = append(live, addr)
+		}
+	}
+	sort.Strings(live)
+	return live
+}
+
+// changed calls OnChange if the live members changed since last time.
+func (m *Memberlist) changed() {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	m.mu.Lock()
+	live := m.liveLocked()
+	same := len(live) == len(m.reported)
+	for i := 0; same && i < len(live); i++ {
+		same = live[i] == m.reported[i]
+	}
+	if same {
+		m.mu.Unlock()
+		return
+	}
+	m.reported = live
+	m.mu.Unlock()
+	if m.config.OnChange != nil {
+		m.config.OnChange(live)
+	}
+}
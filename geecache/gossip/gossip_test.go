@@ -0,0 +1,231 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// network is an in-memory Transport between member lists. Nodes can be
+// taken down, and links between two nodes cut.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Memberlist
+	down  map[string]bool
+	cut   map[[2]string]bool
+}
+
+func newNetwork() *network {
+	return &network{
+		nodes: make(map[string]*Memberlist),
+		down:  make(map[string]bool),
+		cut:   make(map[[2]string]bool),
+	}
+}
+
+var errUnreachable = errors.New("unreachable")
+
+// transport returns the Transport of the node from.
+func (n *network) transport(from string) Transport {
+	return &netTransport{n, from}
+}
+
+func (n *network) reach(from, to string) (*Memberlist, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.down[from] || n.down[to] || n.cut[[2]string{from, to}] || n.cut[[2]string{to, from}] {
+		return nil, errUnreachable
+	}
+	return n.nodes[to], nil
+}
+
+func (n *network) setDown(addr string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[addr] = down
+}
+
+type netTransport struct {
+	n    *network
+	from string
+}
+
+// Ping and PingReq fail once ctx is done, like a real transport.
+func (t *netTransport) Ping(ctx context.Context, addr string, msg *Message) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m, err := t.n.reach(t.from, addr)
+	if err != nil {
+		return nil, err
+	}
+	return m.HandlePing(msg), nil
+}
+
+func (t *netTransport) PingReq(ctx context.Context, via, target string, msg *Message) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m, err := t.n.reach(t.from, via)
+	if err != nil {
+		return nil, err
+	}
+	return m.HandlePingReq(ctx, target, msg)
+}
+
+// recorder keeps the last members passed to OnChange.
+type recorder struct {
+	mu   sync.Mutex
+	live []string
+}
+
+func (r *recorder) onChange(members []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.live = members
+}
+
+func (r *recorder) get() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprint(r.live)
+}
+
+// startCluster starts n member lists that only know about the first one.
+func startCluster(t *testing.T, net *network, n int) ([]*Memberlist, []*recorder) {
+	lists := make([]*Memberlist, n)
+	recs := make([]*recorder, n)
+	for i := range lists {
+		addr := fmt.Sprintf("node%d", i)
+		recs[i] = &recorder{}
+		lists[i] = New(addr, []string{"node0"}, Config{
+			ProbeInterval:  10 * time.Millisecond,
+			ProbeTimeout:   5 * time.Millisecond,
+			SuspectTimeout: 50 * time.Millisecond,
+			Transport:      net.transport(addr),
+			OnChange:       recs[i].onChange,
+		})
+		net.mu.Lock()
+		net.nodes[addr] = lists[i]
+		net.mu.Unlock()
+	}
+	for _, m := range lists {
+		m.Start()
+	}
+	t.Cleanup(func() {
+		for _, m := range lists {
+			m.Stop()
+		}
+	})
+	return lists, recs
+}
+
+// eventually fails the test if cond does not hold within 5 seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConverge(t *testing.T) {
+	lists, recs := startCluster(t, newNetwork(), 4)
+	want := "[node0 node1 node2 node3]"
+	for i := range lists {
+		eventually(t, fmt.Sprintf("node%d knows everyone", i), func() bool {
+			return fmt.Sprint(lists[i].Live()) == want && recs[i].get() == want
+		})
+	}
+}
+
+func TestFailureAndRecovery(t *testing.T) {
+	net := newNetwork()
+	lists, recs := startCluster(t, net, 3)
+	all := "[node0 node1 node2]"
+	for i := range lists {
+		eventually(t, "the cluster converges", func() bool { return recs[i].get() == all })
+	}
+
+	net.setDown("node2", true)
+	for i := 0; i < 2; i++ {
+		eventually(t, fmt.Sprintf("node%d drops node2", i), func() bool {
+			return recs[i].get() == "[node0 node1]"
+		})
+	}
+
+	net.setDown("node2", false)
+	for i := range lists {
+		eventually(t, fmt.Sprintf("node%d takes node2 back", i), func() bool {
+			return recs[i].get() == all
+		})
+	}
+}
+
+func TestIndirectProbe(t *testing.T) {
+	net := newNetwork()
+	lists, _ := startCluster(t, net, 3)
+	for i := range lists {
+		eventually(t, "the cluster converges", func() bool { return len(lists[i].Live()) == 3 })
+	}
+	net.mu.Lock()
+	net.cut[[2]string{"node0", "node2"}] = true
+	net.mu.Unlock()
+
+	// node1 still reaches node2 for node0, so node2 is never declared dead.
+	time.Sleep(300 * time.Millisecond)
+	for _, m := range lists[:2] {
+		for _, mem := range m.Members() {
+			if mem.State == Dead {
+				t.Errorf("%s declared %s dead", m.self, mem.Addr)
+			}
+		}
+	}
+}
+
+func TestLeave(t *testing.T) {
+	lists, recs := startCluster(t, newNetwork(), 3)
+	for i := range lists {
+		eventually(t, "the cluster converges", func() bool { return len(lists[i].Live()) == 3 })
+	}
+	lists[2].Leave(context.Background())
+	for i := 0; i < 2; i++ {
+		// Without waiting for node2 to time out as a suspect.
+		if got := recs[i].get(); got != "[node0 node1]" {
+			t.Errorf("node%d has %s after node2 left", i, got)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	m := New("self", []string{"a"}, Config{Transport: newNetwork().transport("self")})
+	for _, tc := range []struct {
+		u    Member
+		want State
+	}{
+		{Member{"a", Suspect, 0}, Suspect},
+		{Member{"a", Alive, 0}, Suspect}, // same incarnation, not newer
+		{Member{"a", Alive, 1}, Alive},   // refuted
+		{Member{"a", Dead, 0}, Alive},    // older incarnation
+		{Member{"a", Dead, 1}, Dead},
+		{Member{"a", Suspect, 1}, Dead},
+		{Member{"a", Alive, 2}, Alive}, // came back
+	} {
+		m.merge(&Message{Members: []Member{tc.u}})
+		if got := m.members["a"].State; got != tc.want {
+			t.Errorf("after %v: state %v, want %v", tc.u, got, tc.want)
+		}
+	}
+
+	inc := m.members["self"].Incarnation
+	m.merge(&Message{Members: []Member{{"self", Suspect, inc}}})
+	if me := m.members["self"]; me.State != Alive || me.Incarnation != inc+1 {
+		t.Errorf("suspicion of self not refuted: %v", me.Member)
+	}
+}
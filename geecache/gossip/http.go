@@ -0,0 +1,96 @@
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTPTransport sends messages as JSON over HTTP to the handler of
+// ServeHTTP, mounted at Path on every node.
+type HTTPTransport struct {
+	// Path is where members serve gossip, e.g. "/_gossip/".
+	Path string
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Ping implements Transport.
+func (t *HTTPTransport) Ping(ctx context.Context, addr string, msg *Message) (*Message, error) {
+	return t.post(ctx, addr+t.Path+"ping", msg)
+}
+
+// PingReq implements Transport.
+func (t *HTTPTransport) PingReq(ctx context.Context, via, target string, msg *Message) (*Message, error) {
+	return t.post(ctx, via+t.Path+"ping-req?target="+url.QueryEscape(target), msg)
+}
+
+func (t *HTTPTransport) post(ctx context.Context, u string, msg *Message) (*Message, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned: %v", res.Status)
+	}
+	ack := &Message{}
+	if err := json.NewDecoder(res.Body).Decode(ack); err != nil {
+		return nil, fmt.Errorf("decoding response body: %v", err)
+	}
+	return ack, nil
+}
+
+// ServeHTTP serves the messages of HTTPTransport at paths ending in
+// "ping" and "ping-req", and the member table as JSON at paths ending in
+// "members".
+func (m *Memberlist) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var out interface{}
+	switch op := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]; {
+	case op == "members" && r.Method == http.MethodGet:
+		out = m.Members()
+	case (op == "ping" || op == "ping-req") && r.Method == http.MethodPost:
+		msg := &Message{}
+		if err := json.NewDecoder(r.Body).Decode(msg); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if op == "ping" {
+			out = m.HandlePing(msg)
+			break
+		}
+		ack, err := m.HandlePingReq(r.Context(), r.URL.Query().Get("target"), msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		out = ack
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	body, err := json.Marshal(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
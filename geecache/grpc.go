@@ -0,0 +1,446 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geecache/consistenthash"
+	pb "geecache/geecachepb"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// versionMetadata carries the version of a tombstone in the trailer of a
+// Get answered codes.NotFound.
+const versionMetadata = "x-geecache-version"
+
+// GRPCPool implements PeerPicker for a pool of gRPC peers, and serves
+// the GroupCache service to them. It is an alternative to HTTPPool:
+// peers share one multiplexed HTTP/2 connection each and report
+// failures as status codes.
+//
+// Serve the pool with
+//
+//	s := grpc.NewServer()
+//	pool.Register(s)
+type GRPCPool struct {
+	// this peer's address, e.g. "10.0.0.2:8008"
+	self     string
+	dialOpts []grpc.DialOption
+	mu       sync.Mutex // guards members, peers, grpcGetters, groups and draining
+	members  []string   // the current membership, sorted
+	peers    *consistenthash.Map
+	// keyed by address, connections are kept across calls of Set
+	grpcGetters map[string]*grpcGetter
+	groups      map[string]*Group // groups registered with RegisterPeers
+	draining    bool              // set by Drain, this peer is off the ring for good
+	rebalance   rebalancer
+}
+
+// NewGRPCPool initializes a gRPC pool of peers. Without dial options
+// peers are dialed without transport security.
+func NewGRPCPool(self string, opts ...grpc.DialOption) *GRPCPool {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	return &GRPCPool{
+		self:      self,
+		dialOpts:  opts,
+		rebalance: rebalancer{rate: defaultHandoffRate},
+	}
+}
+
+// Log info with server name
+func (p *GRPCPool) Log(format string, v ...interface{}) {
+	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
+}
+
+// Set updates the pool's list of peers. Connections to peers that left
+// are closed. The cached entries this peer no longer owns are handed over
+// to their new owners in the background, like HTTPPool does.
+func (p *GRPCPool) Set(peers ...string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.draining {
+		var others []string
+		for _, peer := range peers {
+			if peer != p.self {
+				others = append(others, peer)
+			}
+		}
+		peers = others
+	}
+
+	getters := make(map[string]*grpcGetter, len(peers))
+	for _, peer := range peers {
+		if peer == p.self {
+			continue
+		}
+		if g, ok := p.grpcGetters[peer]; ok {
+			getters[peer] = g
+			continue
+		}
+		conn, err := grpc.Dial(peer, p.dialOpts...)
+		if err != nil {
+			for peer, g := range getters {
+				if _, ok := p.grpcGetters[peer]; !ok {
+					g.conn.Close()
+				}
+			}
+			return fmt.Errorf("dialing %s: %v", peer, err)
+		}
+		getters[peer] = &grpcGetter{conn: conn, client: pb.NewGroupCacheClient(conn)}
+	}
+	for peer, g := range p.grpcGetters {
+		if _, ok := getters[peer]; !ok {
+			g.conn.Close()
+		}
+	}
+
+	p.members = append([]string(nil), peers...)
+	sort.Strings(p.members)
+	p.peers = consistenthash.New(defaultReplicas, nil)
+	p.peers.Add(peers...)
+	p.grpcGetters = getters
+	p.rebalance.start(p.handoff)
+	return nil
+}
+
+// Peers returns the current cluster membership, including this peer.
+func (p *GRPCPool) Peers() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.members...)
+}
+
+// Close closes the connections to every peer.
+func (p *GRPCPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	for _, g := range p.grpcGetters {
+		if cerr := g.conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	p.grpcGetters = nil
+	p.peers = nil
+	return err
+}
+
+// PickPeer picks the peer that owns key on the consistent hash ring.
+// It returns false when this peer is the owner.
+func (p *GRPCPool) PickPeer(key string) (PeerGetter, bool) {
+	addr, peer, ok := p.owner(key)
+	if !ok {
+		return nil, false
+	}
+	p.Log("Pick peer %s", addr)
+	return peer, true
+}
+
+// owner is PickPeer without the logging, also returning the address.
+func (p *GRPCPool) owner(key string) (string, *grpcGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil {
+		return "", nil, false
+	}
+	if addr := p.peers.GetforKey(key); addr != "" && addr != p.self {
+		return addr, p.grpcGetters[addr], true
+	}
+	return "", nil, false
+}
+
+// PickReplicas returns the peers holding the n replicas of key, see
+// HTTPPool.PickReplicas.
+func (p *GRPCPool) PickReplicas(key string, n int) []PeerGetter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil {
+		return nil
+	}
+	addrs := p.peers.GetN(key, n)
+	replicas := make([]PeerGetter, len(addrs))
+	for i, addr := range addrs {
+		if addr != p.self {
+			replicas[i] = p.grpcGetters[addr]
+		}
+	}
+	return replicas
+}
+
+var _ ReplicaPicker = (*GRPCPool)(nil)
+
+// SetHandoffRate limits the rate at which the pool hands entries over to
+// their new owners, see HTTPPool.SetHandoffRate.
+func (p *GRPCPool) SetHandoffRate(bytesPerSecond int64) {
+	p.rebalance.setRate(bytesPerSecond)
+}
+
+// Drain takes this peer off its ring for good, hands every cached entry
+// over to its new owner and flushes the write-behind writes of the
+// groups, see HTTPPool.Drain.
+func (p *GRPCPool) Drain(ctx context.Context) error {
+	p.mu.Lock()
+	p.draining = true
+	if p.peers != nil {
+		p.peers.Remove(p.self)
+		if i := sort.SearchStrings(p.members, p.self); i < len(p.members) && p.members[i] == p.self {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+		}
+	}
+	p.mu.Unlock()
+	err := p.rebalance.drain(ctx, func(ctx context.Context, t *throttle) error {
+		return p.handoffGroups(ctx, t)
+	})
+	for _, g := range p.registeredGroups() {
+		if ferr := g.Flush(ctx); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// handoff runs handoffGroups for the rebalancer.
+func (p *GRPCPool) handoff(ctx context.Context, t *throttle) {
+	if err := p.handoffGroups(ctx, t); err != nil && err != context.Canceled {
+		p.Log("handing off entries: %v", err)
+	}
+}
+
+// handoffGroups hands the entries of the groups registered with the pool
+// over to their owners.
+func (p *GRPCPool) handoffGroups(ctx context.Context, t *throttle) error {
+	for _, g := range p.registeredGroups() {
+		if err := g.handoff(ctx, p.PickReplicas, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registeredGroups returns the groups registered with RegisterPeers.
+func (p *GRPCPool) registeredGroups() []*Group {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	groups := make([]*Group, 0, len(p.groups))
+	for _, g := range p.groups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+var _ PeerPicker = (*GRPCPool)(nil)
+
+// registerGroup makes the pool serve g, so several pools in one process
+// can serve groups of the same name.
+func (p *GRPCPool) registerGroup(g *Group) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.groups == nil {
+		p.groups = make(map[string]*Group)
+	}
+	p.groups[g.name] = g
+}
+
+// lookupGroup looks up the named group. Groups registered with this
+// pool take precedence over the ones of GetGroup.
+func (p *GRPCPool) lookupGroup(name string) (*Group, error) {
+	p.mu.Lock()
+	group := p.groups[name]
+	p.mu.Unlock()
+	if group == nil {
+		group = GetGroup(name)
+	}
+	if group == nil {
+		return nil, status.Errorf(codes.NotFound, "no such group: %s", name)
+	}
+	return group, nil
+}
+
+// Register registers the GroupCache service of the pool with s.
+func (p *GRPCPool) Register(s *grpc.Server) {
+	pb.RegisterGroupCacheServer(s, &grpcServer{pool: p})
+}
+
+// grpcServer serves the GroupCache service for the groups of pool.
+type grpcServer struct {
+	pb.UnimplementedGroupCacheServer
+	pool *GRPCPool
+}
+
+// Get implements the GroupCache service. Requests come from peers, so
+// they are served by this node and never forwarded.
+func (s *grpcServer) Get(ctx context.Context, in *pb.Request) (*pb.Response, error) {
+	group, err := s.pool.lookupGroup(in.Group)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := group.servePeerGet(ctx, in)
+	if errors.Is(err, ErrNotFound) && out.Version != 0 {
+		// A tombstone answers its version in the trailer.
+		grpc.SetTrailer(ctx, metadata.Pairs(versionMetadata, strconv.FormatInt(out.Version, 10)))
+	}
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return out, nil
+}
+
+// Delete implements the GroupCache service.
+func (s *grpcServer) Delete(ctx context.Context, in *pb.Request) (*pb.DeleteResponse, error) {
+	group, err := s.pool.lookupGroup(in.Group)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := group.servePeerDelete(ctx, in)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.DeleteResponse{Deleted: deleted}, nil
+}
+
+// Set implements the GroupCache service.
+func (s *grpcServer) Set(ctx context.Context, in *pb.Request) (*pb.SetResponse, error) {
+	group, err := s.pool.lookupGroup(in.Group)
+	if err != nil {
+		return nil, err
+	}
+	if in.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+	if err := group.servePeerSet(ctx, in); err != nil {
+		return nil, statusError(err)
+	}
+	return &pb.SetResponse{}, nil
+}
+
+// GetMany implements the GroupCache service. A failed key fails only
+// its own result.
+func (s *grpcServer) GetMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	return s.batch(ctx, in, func(req *pb.Request, res *pb.Result) error {
+		out, err := s.Get(ctx, req)
+		if err == nil {
+			res.Value, res.Version, res.Stale = out.Value, out.Version, out.Stale
+		}
+		return err
+	})
+}
+
+// DeleteMany implements the GroupCache service.
+func (s *grpcServer) DeleteMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	return s.batch(ctx, in, func(req *pb.Request, res *pb.Result) error {
+		out, err := s.Delete(ctx, req)
+		if err == nil {
+			res.Deleted = out.Deleted
+		}
+		return err
+	})
+}
+
+// SetMany implements the GroupCache service.
+func (s *grpcServer) SetMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	return s.batch(ctx, in, func(req *pb.Request, res *pb.Result) error {
+		_, err := s.Set(ctx, req)
+		return err
+	})
+}
+
+// batch runs fn for every request of in, in parallel like runBatch, and
+// collects the results. It gives up on the whole batch once ctx is done.
+func (s *grpcServer) batch(ctx context.Context, in *pb.BatchRequest, fn func(*pb.Request, *pb.Result) error) (*pb.BatchResponse, error) {
+	out := &pb.BatchResponse{Results: make([]*pb.Result, len(in.Requests))}
+	runRequests(in.Requests, func(i int) {
+		req := in.Requests[i]
+		res := &pb.Result{Key: req.Key}
+		if ctx.Err() == nil {
+			if err := fn(req, res); err != nil {
+				// The status message is ErrNotFound's text for a missing key.
+				res.Error = status.Convert(err).Message()
+			}
+		}
+		out.Results[i] = res
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	return out, nil
+}
+
+// statusError maps context errors to their status codes and ErrNotFound
+// to codes.NotFound, with ErrNotFound's text to tell it from an unknown
+// group. Other errors are reported as codes.Unknown.
+func statusError(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	if errors.Is(err, ErrNotFound) {
+		return status.Error(codes.NotFound, ErrNotFound.Error())
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+var _ pb.GroupCacheServer = (*grpcServer)(nil)
+
+type grpcGetter struct {
+	conn   *grpc.ClientConn
+	client pb.GroupCacheClient
+}
+
+func (g *grpcGetter) Get(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	var trailer metadata.MD
+	res, err := g.client.Get(ctx, in, grpc.Trailer(&trailer))
+	if s, ok := status.FromError(err); ok && s.Code() == codes.NotFound && s.Message() == ErrNotFound.Error() {
+		if v := trailer.Get(versionMetadata); len(v) > 0 {
+			out.Version, _ = strconv.ParseInt(v[0], 10, 64)
+		}
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	out.Value = res.Value
+	out.Version = res.Version
+	out.Stale = res.Stale
+	return nil
+}
+
+func (g *grpcGetter) Delete(ctx context.Context, in *pb.Request) (bool, error) {
+	res, err := g.client.Delete(ctx, in)
+	if err != nil {
+		log.Printf("Error sending delete: %v", err)
+		return false, err
+	}
+	return res.Deleted, nil
+}
+
+func (g *grpcGetter) Set(ctx context.Context, in *pb.Request) error {
+	_, err := g.client.Set(ctx, in)
+	return err
+}
+
+// GetMany gets several keys from the peer in one request.
+func (g *grpcGetter) GetMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	return g.client.GetMany(ctx, in)
+}
+
+// DeleteMany deletes several keys from the peer in one request.
+func (g *grpcGetter) DeleteMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	return g.client.DeleteMany(ctx, in)
+}
+
+// SetMany stores several keys on the peer in one request.
+func (g *grpcGetter) SetMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error) {
+	return g.client.SetMany(ctx, in)
+}
+
+var _ BatchPeerGetter = (*grpcGetter)(nil)
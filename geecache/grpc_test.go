@@ -0,0 +1,251 @@
+package geecache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	pb "geecache/geecachepb"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestGRPCCluster is newTestCluster with nodes talking gRPC.
+func newTestGRPCCluster(t *testing.T, n int, name string, getter Getter, opts ...GroupOption) ([]*Group, []*GRPCPool, func()) {
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range listeners {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = lis
+		addrs[i] = lis.Addr().String()
+	}
+	servers := make([]*grpc.Server, n)
+	pools := make([]*GRPCPool, n)
+	groups := make([]*Group, n)
+	for i := range pools {
+		pools[i] = NewGRPCPool(addrs[i])
+		if err := pools[i].Set(addrs...); err != nil {
+			t.Fatal(err)
+		}
+		groups[i] = NewGroup(name, 2<<20, getter, opts...)
+		groups[i].RegisterPeers(pools[i])
+		servers[i] = grpc.NewServer()
+		pools[i].Register(servers[i])
+		go servers[i].Serve(listeners[i])
+	}
+	return groups, pools, func() {
+		for i := range servers {
+			pools[i].Close()
+			servers[i].Stop()
+		}
+	}
+}
+
+func TestGRPCPool(t *testing.T) {
+	groups, _, stop := newTestGRPCCluster(t, 2, "grpc", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			if key == "missing" {
+				return nil, fmt.Errorf("%s not found", key)
+			}
+			return []byte("db " + key), nil
+		}))
+	defer stop()
+	ctx := context.Background()
+
+	key := remoteKey(groups[0])
+	view, source, err := groups[0].GetWithSource(ctx, key, false)
+	if err != nil || source != FromPeer || view.String() != "db "+key {
+		t.Fatalf("Get from non-owner = %q, source %v, err %v", view.String(), source, err)
+	}
+
+	value := []byte{0, 0xff, '\n'}
+	if err := groups[0].Add(ctx, key, ByteView{b: value}, time.Minute, false); err != nil {
+		t.Fatalf("Add through peer: %v", err)
+	}
+	if view, err := groups[1].Get(ctx, key, true); err != nil || !bytes.Equal(view.ByteSlice(), value) {
+		t.Fatalf("owner Get after Add = %q, %v; want %q", view.ByteSlice(), err, value)
+	}
+
+	if n, err := groups[0].Delete(ctx, key, false); err != nil || n != 1 {
+		t.Fatalf("Delete through peer = %d, %v; want 1", n, err)
+	}
+	if n, err := groups[0].Delete(ctx, key, false); err != nil || n != 0 {
+		t.Fatalf("second Delete through peer = %d, %v; want 0", n, err)
+	}
+}
+
+func TestGRPCStatusCodes(t *testing.T) {
+	_, pools, stop := newTestGRPCCluster(t, 2, "grpc-codes", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			if key == "missing" {
+				return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+			}
+			return nil, fmt.Errorf("%s not found", key)
+		}))
+	defer stop()
+	peer := pools[0].grpcGetters[pools[1].self]
+
+	err := peer.Get(context.Background(), &pb.Request{Group: "no-such-group", Key: "k"}, &pb.Response{})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Get of unknown group: code %v, err %v; want NotFound", status.Code(err), err)
+	}
+	err = peer.Get(context.Background(), &pb.Request{Group: "grpc-codes", Key: "k"}, &pb.Response{})
+	if status.Code(err) != codes.Unknown {
+		t.Errorf("Get of failing key: code %v, err %v; want Unknown", status.Code(err), err)
+	}
+	err = peer.Get(context.Background(), &pb.Request{Group: "grpc-codes", Key: "missing"}, &pb.Response{})
+	if err != ErrNotFound {
+		t.Errorf("Get of missing key: err %v, want ErrNotFound", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = peer.Get(ctx, &pb.Request{Group: "grpc-codes", Key: "k"}, &pb.Response{})
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("Get with cancelled context: code %v, err %v; want Canceled", status.Code(err), err)
+	}
+}
+
+func TestGRPCBatch(t *testing.T) {
+	_, pools, stop := newTestGRPCCluster(t, 2, "grpc-batch", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			if key == "missing" {
+				return nil, fmt.Errorf("%s not found", key)
+			}
+			return []byte("db " + key), nil
+		}))
+	defer stop()
+	peer := pools[0].grpcGetters[pools[1].self]
+	ctx := context.Background()
+
+	set, err := peer.SetMany(ctx, &pb.BatchRequest{Requests: []*pb.Request{
+		{Group: "grpc-batch", Key: "a", Value: []byte("1")},
+		{Group: "no-such-group", Key: "b", Value: []byte("2")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Results[0].Error != "" || set.Results[1].Error == "" {
+		t.Fatalf("SetMany results = %v, want only the unknown group to fail", set.Results)
+	}
+
+	got, err := peer.GetMany(ctx, &pb.BatchRequest{Requests: []*pb.Request{
+		{Group: "grpc-batch", Key: "a"},
+		{Group: "grpc-batch", Key: "missing"},
+		{Group: "grpc-batch", Key: "c"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Results) != 3 {
+		t.Fatalf("GetMany returned %d results, want 3", len(got.Results))
+	}
+	if r := got.Results[0]; r.Key != "a" || string(r.Value) != "1" || r.Error != "" {
+		t.Errorf("GetMany result 0 = %v", r)
+	}
+	if r := got.Results[1]; r.Key != "missing" || r.Error == "" {
+		t.Errorf("GetMany result 1 = %v, want an error", r)
+	}
+	if r := got.Results[2]; string(r.Value) != "db c" || r.Error != "" {
+		t.Errorf("GetMany result 2 = %v", r)
+	}
+
+	del, err := peer.DeleteMany(ctx, &pb.BatchRequest{Requests: []*pb.Request{
+		{Group: "grpc-batch", Key: "a"},
+		{Group: "grpc-batch", Key: "a"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !del.Results[0].Deleted || del.Results[1].Deleted {
+		t.Errorf("DeleteMany results = %v, want only the first to delete", del.Results)
+	}
+}
+
+func TestGRPCDrain(t *testing.T) {
+	var calls int32
+	groups, pools, stop := newTestGRPCCluster(t, 2, "grpc-drain", countingGetter(&calls))
+	defer stop()
+	ctx := context.Background()
+	const n = 100
+	for i := 0; i < n; i++ {
+		if _, err := groups[0].Get(ctx, fmt.Sprint(i), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pools[1].SetHandoffRate(0)
+	if err := pools[1].Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if items := groups[1].CacheStats(MainCache).Items; items != 0 {
+		t.Errorf("%d entries left after Drain", items)
+	}
+	if err := pools[0].Set(pools[0].self); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := groups[0].Get(ctx, fmt.Sprint(i), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := atomic.LoadInt32(&calls); calls != n {
+		t.Errorf("getter called %d times, want %d: drained keys were loaded again", calls, n)
+	}
+}
+
+func TestGRPCDrainFlushes(t *testing.T) {
+	store := newFakeStore()
+	groups, pools, stop := newTestGRPCCluster(t, 2, "grpc-drain-flush", store,
+		WithWriteBehind(WriteBehind{FlushInterval: time.Hour}))
+	defer stop()
+	ctx := context.Background()
+
+	// Stored on its owner, node 1, which queues the write.
+	key := remoteKey(groups[0])
+	if err := groups[1].Set(ctx, key, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.get(key); ok {
+		t.Fatal("write-behind write reached the store before Drain")
+	}
+	if err := pools[1].Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := store.get(key); v != "v" {
+		t.Errorf("store after Drain has %s = %q, want v", key, v)
+	}
+}
+
+func TestGRPCTombstoneVersion(t *testing.T) {
+	groups, pools, stop := newTestGRPCCluster(t, 3, "grpc-tombstone", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}), WithReplication(Replication{N: 3}))
+	defer stop()
+	ctx := context.Background()
+
+	if err := groups[0].Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := groups[0].Delete(ctx, "k", false); err != nil {
+		t.Fatal(err)
+	}
+	// The replicas answer the delete's version with ErrNotFound.
+	for _, peer := range pools[0].PickReplicas("k", 3) {
+		if peer == nil {
+			continue
+		}
+		view, err := groups[0].getFromPeer(ctx, peer, "k", false)
+		if !errors.Is(err, ErrNotFound) || view.version == 0 {
+			t.Errorf("Get of a deleted key = version %d, %v; want ErrNotFound with a version", view.version, err)
+		}
+	}
+}
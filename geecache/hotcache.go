@@ -0,0 +1,69 @@
+package geecache
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// defaultHotTTL is how long a value stays in the hot cache unless
+	// set otherwise.
+	defaultHotTTL = 10 * time.Second
+	// defaultHotAdmitRate is the chance of a value fetched from a peer to
+	// enter the hot cache unless set otherwise.
+	defaultHotAdmitRate = 0.1
+)
+
+// HotCacheConfig configures WithHotCache.
+type HotCacheConfig struct {
+	// Bytes is the size of the hot cache. There is no hot cache unless it
+	// is positive.
+	Bytes int64
+	// TTL is how long a value stays in the hot cache, 10 seconds by
+	// default. A hot value is a copy, so it can be that much behind the
+	// owner's value after a write through another peer.
+	TTL time.Duration
+	// AdmitRate is the chance of a value fetched from a peer to enter the
+	// hot cache, 1 in 10 by default, so most values that get in are the
+	// ones fetched often.
+	AdmitRate float64
+}
+
+// WithHotCache gives the group a second cache, besides the main cache of
+// the keys this peer owns, for values fetched from other peers. A hot key
+// is then served by every peer rather than bottlenecked on its owner.
+// Like the main cache, the hot cache evicts with the group's policy.
+// A config with no Bytes leaves the group without a hot cache.
+func WithHotCache(h HotCacheConfig) GroupOption {
+	if h.TTL <= 0 {
+		h.TTL = defaultHotTTL
+	}
+	if h.AdmitRate <= 0 {
+		h.AdmitRate = defaultHotAdmitRate
+	}
+	return func(g *Group) {
+		if h.Bytes <= 0 {
+			g.hot = nil
+			return
+		}
+		g.hot = &h
+		g.hotCache.cacheBytes = h.Bytes
+	}
+}
+
+// getHot looks key up in the hot cache.
+func (g *Group) getHot(key string) (ByteView, bool) {
+	if g.hot == nil {
+		return ByteView{}, false
+	}
+	return g.hotCache.get(key)
+}
+
+// admitHot adds a value fetched from a peer to the hot cache, with a
+// chance of the hot cache's admit rate.
+func (g *Group) admitHot(key string, value ByteView) {
+	if g.hot == nil || rand.Float64() >= g.hot.AdmitRate {
+		return
+	}
+	g.hotCache.add(key, value, g.hot.TTL)
+}
@@ -0,0 +1,84 @@
+package geecache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHotCache(t *testing.T) {
+	groups, _, stop := newTestCluster(2, "hot", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return []byte("db " + key), nil
+		}), WithHotCache(HotCacheConfig{Bytes: 1 << 20, TTL: 100 * time.Millisecond, AdmitRate: 1}))
+	defer stop()
+	ctx := context.Background()
+	key := remoteKey(groups[0])
+
+	for i, want := range []Source{FromPeer, FromCache, FromCache} {
+		if _, source, err := groups[0].GetWithSource(ctx, key, false); err != nil || source != want {
+			t.Fatalf("Get %d: source %v, err %v; want %v", i, source, err, want)
+		}
+	}
+	if n := groups[1].Stats.ServerRequests.Get(); n != 1 {
+		t.Errorf("owner served %d requests, want 1", n)
+	}
+	if s := groups[0].CacheStats(HotCache); s.Items != 1 || s.Hits != 2 {
+		t.Errorf("hot cache stats = %+v", s)
+	}
+	if s := groups[0].CacheStats(MainCache); s.Items != 0 {
+		t.Errorf("main cache of a non-owner holds %d items", s.Items)
+	}
+
+	// A write through this peer drops the hot copy.
+	if err := groups[0].Set(ctx, key, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	view, source, err := groups[0].GetWithSource(ctx, key, false)
+	if err != nil || source != FromPeer || view.String() != "new" {
+		t.Fatalf("Get after Set = %q, source %v, err %v", view.String(), source, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, source, _ := groups[0].GetWithSource(ctx, key, false); source != FromPeer {
+		t.Errorf("Get after the hot TTL: source %v, want %v", source, FromPeer)
+	}
+}
+
+func TestHotCacheAdmitRate(t *testing.T) {
+	groups, _, stop := newTestCluster(2, "hot-admit", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return []byte("db " + key), nil
+		}), WithHotCache(HotCacheConfig{Bytes: 1 << 20}))
+	defer stop()
+	ctx := context.Background()
+	key := remoteKey(groups[0])
+
+	// At 1 in 10, a key fetched 200 times is all but sure to get in.
+	gets := 0
+	for ; gets < 200; gets++ {
+		if _, source, _ := groups[0].GetWithSource(ctx, key, false); source == FromCache {
+			break
+		}
+	}
+	if gets == 200 {
+		t.Fatal("a key fetched 200 times never entered the hot cache")
+	}
+}
+
+func TestHotCacheZeroBytes(t *testing.T) {
+	groups, _, stop := newTestCluster(2, "hot-zero", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return []byte("db " + key), nil
+		}), WithHotCache(HotCacheConfig{Bytes: 0, AdmitRate: 1}))
+	defer stop()
+	ctx := context.Background()
+	key := remoteKey(groups[0])
+
+	// No bytes is no hot cache, rather than an unbounded one.
+	for i := 0; i < 3; i++ {
+		if _, source, err := groups[0].GetWithSource(ctx, key, false); err != nil || source != FromPeer {
+			t.Fatalf("Get %d: source %v, %v; want %v", i, source, err, FromPeer)
+		}
+	}
+}
@@ -1,41 +1,88 @@
 package geecache
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"geecache/consistenthash"
+	pb "geecache/geecachepb"
+	"geecache/gossip"
+	"geecache/metrics"
 
 	"bytes"
 	"io/ioutil"
 	"log"
-	"net"
+	"mime"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
 )
 
 const (
 	defaultBasePath = "/"
 	defaultReplicas = 50
+	// statsPath, under the base path, serves the stats of every group.
+	// Group names starting with "_" are reserved for such paths.
+	statsPath = "_stats"
+	// metricsPath, under the base path, serves Prometheus metrics.
+	metricsPath = "metrics"
+	// peersPath, under the base path, serves the membership admin API.
+	peersPath = "_peers"
+	// gossipPath, under the base path, serves the gossip protocol.
+	gossipPath = "_gossip/"
+	// mgetPath, msetPath and mdeletePath, under the base path, serve the
+	// batch API.
+	mgetPath    = "_mget"
+	msetPath    = "_mset"
+	mdeletePath = "_mdelete"
+	// protobufContentType is the media type of protobuf encoded bodies.
+	protobufContentType = "application/x-protobuf"
+	// octetStreamContentType is the media type of raw values.
+	octetStreamContentType = "application/octet-stream"
+	// staleHeader marks a value answered past its soft or hard TTL.
+	staleHeader = "X-Geecache-Stale"
 )
 
 // HTTPPool implements PeerPicker for a pool of HTTP peers.
 type HTTPPool struct {
 	// this peer's base URL, e.g. "https://example.net:8000"
-	self        string
-	basePath    string
-	mu          sync.Mutex // guards peers and httpGetters
-	peers       *consistenthash.Map
-	httpGetters map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
+	self     string
+	basePath string
+	// group used when a request path names no group
+	defaultGroup string
+	mu           sync.Mutex // guards defaultGroup, members, peers, httpGetters, groups, gossip and draining
+	members      []string   // the current membership, sorted
+	peers        *consistenthash.Map
+	httpGetters  map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
+	groups       map[string]*Group      // groups registered with RegisterPeers
+	gossip       *gossip.Memberlist     // set by StartGossip
+	draining     bool                   // set by Drain, this peer is off the ring for good
+	rebalance    rebalancer
+
+	requests        *metrics.CounterVec   // by method, group and status code
+	requestDuration *metrics.HistogramVec // by method and group
+	peerDuration    *metrics.HistogramVec // by peer and operation
 }
 
 // NewHTTPPool initializes an HTTP pool of peers.
 func NewHTTPPool(self string) *HTTPPool {
 	return &HTTPPool{
-		self:     self,
-		basePath: defaultBasePath,
+		self:      self,
+		basePath:  defaultBasePath,
+		rebalance: rebalancer{rate: defaultHandoffRate},
+		requests: metrics.NewCounterVec("geecache_http_requests_total",
+			"HTTP requests served, by method, group and status code.", "method", "group", "code"),
+		requestDuration: metrics.NewHistogramVec("geecache_http_request_duration_seconds",
+			"Time to serve HTTP requests, by method and group.", metrics.DefBuckets, "method", "group"),
+		peerDuration: metrics.NewHistogramVec("geecache_peer_request_duration_seconds",
+			"Time of requests to other peers, by peer and operation.", metrics.DefBuckets, "peer", "op"),
 	}
 }
 
@@ -45,47 +92,89 @@ func (p *HTTPPool) Log(format string, v ...interface{}) {
 }
 
 // ServeHTTP handle all http requests
+//
+// GET and DELETE accept /<group>/<key>, POST accepts /<group> with a JSON
+// object body and an optional ttl query parameter, e.g. ?ttl=30s. The
+// group may be left out, e.g. /<key>, in which case the default group is
+// used.
+//
+// Values are binary safe through the raw API: GET with an Accept header
+// of application/octet-stream answers the value's bytes, and PUT
+// /<group>/<key> stores the request body verbatim, with the same ttl
+// query parameter as POST.
+//
+// Peers send a protobuf Request body instead, see servePeer.
 func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	local := r.URL.Query().Get("local") == "true"
-	hostPort := r.Host // 返回如 "localhost:8001"
-	_, port, err := net.SplitHostPort(hostPort)
-	if err != nil {
-		// handle error
-	}
-	fmt.Println(port) // 这里会打印 "8001"
 	if !strings.HasPrefix(r.URL.Path, p.basePath) {
 		panic("HTTPPool serving unexpected path: " + r.URL.Path)
 	}
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+	p.serveHTTP(sw, r)
+	group := p.groupLabel(r)
+	p.requests.Add(1, r.Method, group, strconv.Itoa(sw.code))
+	p.requestDuration.With(r.Method, group).ObserveSince(start)
+}
+
+func (p *HTTPPool) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	local := r.URL.Query().Get("local") == "true"
+	// Gossip is too chatty to log.
+	if strings.HasPrefix(r.URL.Path[len(p.basePath):], gossipPath) {
+		if m := p.memberlist(); m != nil {
+			m.ServeHTTP(w, r)
+		} else {
+			http.Error(w, "gossip is off", http.StatusNotFound)
+		}
+		return
+	}
 	p.Log("%s %s", r.Method, r.URL.Path)
+	switch r.URL.Path[len(p.basePath):] {
+	case statsPath:
+		p.serveStats(w, r)
+		return
+	case metricsPath:
+		p.serveMetrics(w, r)
+		return
+	case peersPath:
+		p.servePeers(w, r, local)
+		return
+	}
 	parts := strings.SplitN(r.URL.Path[len(p.basePath):], "/", 2)
+	switch parts[0] {
+	case mgetPath, msetPath, mdeletePath:
+		p.serveBatch(w, r, parts, local)
+		return
+	}
+	if isContentType(r.Header, protobufContentType) {
+		p.servePeer(w, r)
+		return
+	}
 	switch r.Method {
 	case "GET":
-		if len(parts) < 1 || len(parts) > 2 {
-			http.Error(w, "bad request", http.StatusBadRequest)
+		group, key, ok := p.groupAndKey(w, parts)
+		if !ok {
 			return
 		}
-		groupName := "scores"
-		var key string
-		//key := parts[1]
-		if len(parts) == 1 {
-			key = parts[0]
-		} else {
-			groupName = parts[0]
-			key = parts[1]
-		}
-		group := GetGroup("scores")
-		if group == nil {
-			http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+		view, source, err := group.GetWithSource(r.Context(), key, local)
+		if errors.Is(err, ErrNotFound) {
+			w.Header().Set("X-Geecache-Source", source.String())
+			http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
 			return
 		}
-		view, err, _ := group.Get(key, port, local)
 		if err != nil {
-			http.Error(w, "Not Found", http.StatusNotFound)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("X-Geecache-Source", source.String())
+		if view.stale {
+			w.Header().Set(staleHeader, "true")
+		}
+		if accepts(r, octetStreamContentType) {
+			w.Header().Set("Content-Type", octetStreamContentType)
+			w.Write(view.ByteSlice())
 			return
 		}
 		body, err := json.Marshal(map[string]string{key: string(view.ByteSlice())})
-		fmt.Println("JSON Body:", body)
-
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -94,6 +183,19 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Write(body)
 
 	case "POST":
+		if len(parts) == 2 && parts[1] != "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		group := p.group(w, parts[0])
+		if group == nil {
+			return
+		}
+		ttl, ok := parseTTL(w, r)
+		if !ok {
+			return
+		}
+
 		body, _ := ioutil.ReadAll(r.Body)
 		log.Printf("[HTTPPool] Received POST request with body: %s", string(body)) // 添加此日志
 
@@ -118,34 +220,45 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				strVal = string(jsonVal)
 			}
 
-			group := GetGroup("scores")
-			jsonData := string(body)
-
-			group.Add(key, ByteView{b: []byte(strVal)}, port, local, jsonData)
+			if err := group.Add(r.Context(), key, ByteView{b: []byte(strVal)}, ttl, local); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
 		}
 
 		w.WriteHeader(http.StatusOK)
 
-	case "DELETE":
-		if len(parts) < 1 || len(parts) > 2 {
+	case "PUT":
+		group, key, ok := p.groupAndKey(w, parts)
+		if !ok {
+			return
+		}
+		ttl, ok := parseTTL(w, r)
+		if !ok {
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		groupName := "scores"
-		var key string
-		if len(parts) == 1 {
-			key = parts[0]
-		} else {
-			groupName = parts[0]
-			key = parts[1]
+		if err := group.Add(r.Context(), key, ByteView{b: body}, ttl, local); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
 		}
-		group := GetGroup("scores")
-		if group == nil {
-			http.Error(w, "no such group:"+groupName, http.StatusNotFound)
+		w.WriteHeader(http.StatusOK)
+
+	case "DELETE":
+		group, key, ok := p.groupAndKey(w, parts)
+		if !ok {
 			return
 		}
 
-		deletedCount := group.Delete(key, port, local)
+		deletedCount, err := group.Delete(r.Context(), key, local)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(strconv.Itoa(deletedCount)))
@@ -154,120 +267,467 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// servePeer serves a request of a peer, which sends a protobuf Request
+// body and gets a protobuf answer, as over gRPC: GET answers a Response,
+// POST stores the key and answers a SetResponse, and DELETE answers a
+// DeleteResponse. A missing key is answered with 404 and a Response
+// holding the version of its tombstone, if any.
+func (p *HTTPPool) servePeer(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	in := &pb.Request{}
+	if err == nil {
+		err = proto.Unmarshal(body, in)
+	}
+	if err != nil || in.Key == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	group := p.group(w, in.Group)
+	if group == nil {
+		return
+	}
+	var out proto.Message
+	switch r.Method {
+	case http.MethodGet:
+		res, source, err := group.servePeerGet(r.Context(), in)
+		w.Header().Set("X-Geecache-Source", source.String())
+		if errors.Is(err, ErrNotFound) {
+			writeProto(w, http.StatusNotFound, res)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		out = res
+	case http.MethodPost:
+		if err := group.servePeerSet(r.Context(), in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		out = &pb.SetResponse{}
+	case http.MethodDelete:
+		deleted, err := group.servePeerDelete(r.Context(), in)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		out = &pb.DeleteResponse{Deleted: deleted}
+	default:
+		http.Error(w, "not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeProto(w, http.StatusOK, out)
+}
+
+// writeProto writes m as a protobuf body with the status code.
+func writeProto(w http.ResponseWriter, code int, m proto.Message) {
+	body, err := proto.Marshal(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", protobufContentType)
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// groupAndKey resolves the group and key of a /<group>/<key> or /<key>
+// path, writing an error response if that fails.
+func (p *HTTPPool) groupAndKey(w http.ResponseWriter, parts []string) (*Group, string, bool) {
+	groupName, key := "", parts[0]
+	if len(parts) == 2 {
+		groupName, key = parts[0], parts[1]
+	}
+	if key == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return nil, "", false
+	}
+	group := p.group(w, groupName)
+	return group, key, group != nil
+}
+
+// group looks up the named group like lookupGroup. It writes a 404
+// response if there's no such group.
+func (p *HTTPPool) group(w http.ResponseWriter, name string) *Group {
+	group := p.lookupGroup(name)
+	if group == nil {
+		if name == "" {
+			name = "(default)"
+		}
+		http.Error(w, "no such group: "+name, http.StatusNotFound)
+	}
+	return group
+}
+
+// parseTTL parses the optional ttl query parameter, e.g. ?ttl=30s. It
+// writes an error and returns false if the ttl is malformed.
+func parseTTL(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	s := r.URL.Query().Get("ttl")
+	if s == "" {
+		return 0, true
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl < 0 {
+		http.Error(w, "bad ttl: "+s, http.StatusBadRequest)
+		return 0, false
+	}
+	return ttl, true
+}
+
+// lookupGroup looks up the named group, falling back to the default group
+// when name is empty. Groups registered with this pool take precedence
+// over the ones of GetGroup.
+func (p *HTTPPool) lookupGroup(name string) *Group {
+	p.mu.Lock()
+	if name == "" {
+		name = p.defaultGroup
+	}
+	group := p.groups[name]
+	p.mu.Unlock()
+	if group == nil {
+		group = GetGroup(name)
+	}
+	return group
+}
+
+// groupStats is the JSON form of one group's stats served at statsPath.
+type groupStats struct {
+	Group     *Stats     `json:"group"`
+	MainCache CacheStats `json:"main_cache"`
+	HotCache  CacheStats `json:"hot_cache"`
+}
+
+// serveStats writes the stats of every group served by the pool as JSON.
+func (p *HTTPPool) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := make(map[string]groupStats)
+	for name, g := range p.allGroups() {
+		stats[name] = groupStats{
+			Group:     &g.Stats,
+			MainCache: g.CacheStats(MainCache),
+			HotCache:  g.CacheStats(HotCache),
+		}
+	}
+	body, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// allGroups returns the groups of GetGroup, overridden by the groups
+// registered with the pool.
+func (p *HTTPPool) allGroups() map[string]*Group {
+	all := make(map[string]*Group)
+	mu.RLock()
+	for name, g := range groups {
+		all[name] = g
+	}
+	mu.RUnlock()
+	p.mu.Lock()
+	for name, g := range p.groups {
+		all[name] = g
+	}
+	p.mu.Unlock()
+	return all
+}
+
+// registerGroup makes the pool serve g, so several pools in one process
+// can serve groups of the same name.
+func (p *HTTPPool) registerGroup(g *Group) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.groups == nil {
+		p.groups = make(map[string]*Group)
+	}
+	p.groups[g.name] = g
+}
+
+// SetDefaultGroup sets the group that serves requests whose path has
+// no group, e.g. GET /<key>.
+func (p *HTTPPool) SetDefaultGroup(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.defaultGroup = name
+}
+
 // Set updates the pool's list of peers.
+//
+// Whenever the peers change, the cached entries this peer no longer owns
+// are handed over to their new owners in the background, see
+// SetHandoffRate.
 func (p *HTTPPool) Set(peers ...string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	log.Printf("[HTTPPool] Setting peers: %v", peers)
 
+	p.members = nil
 	p.peers = consistenthash.New(defaultReplicas, nil)
-	p.peers.Add(peers...)
-
 	p.httpGetters = make(map[string]*httpGetter, len(peers))
+	p.addLocked(peers)
+	p.rebalance.start(p.handoff)
+}
+
+// AddPeers adds peers to the pool's list of peers, keeping the others.
+func (p *HTTPPool) AddPeers(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	log.Printf("[HTTPPool] Adding peers: %v", peers)
+	if p.peers == nil {
+		p.peers = consistenthash.New(defaultReplicas, nil)
+		p.httpGetters = make(map[string]*httpGetter, len(peers))
+	}
+	p.addLocked(peers)
+	p.rebalance.start(p.handoff)
+}
+
+// RemovePeers removes peers from the pool's list of peers.
+func (p *HTTPPool) RemovePeers(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	log.Printf("[HTTPPool] Removing peers: %v", peers)
+	for _, peer := range peers {
+		if _, ok := p.httpGetters[peer]; !ok {
+			continue
+		}
+		delete(p.httpGetters, peer)
+		p.peers.Remove(peer)
+		i := sort.SearchStrings(p.members, peer)
+		p.members = append(p.members[:i], p.members[i+1:]...)
+	}
+	p.rebalance.start(p.handoff)
+}
+
+// addLocked adds the peers that are not members yet. p.mu must be held.
+func (p *HTTPPool) addLocked(peers []string) {
 	for _, peer := range peers {
-		p.httpGetters[peer] = &httpGetter{baseURL: peer + p.basePath}
+		if _, ok := p.httpGetters[peer]; ok || (p.draining && peer == p.self) {
+			continue
+		}
+		p.members = append(p.members, peer)
+		p.peers.Add(peer)
+		p.httpGetters[peer] = &httpGetter{
+			baseURL:  peer + p.basePath,
+			duration: p.peerDuration,
+			peer:     peer,
+		}
 		log.Printf("[HTTPPool] Created httpGetter for peer: %s with baseURL: %s", peer, peer+p.basePath)
 	}
+	sort.Strings(p.members)
 }
 
-// PickPeer picks a peer according to key
-func (p *HTTPPool) PickPeer(peeraddr string) (PeerGetter, string, string) {
+// Peers returns the current cluster membership, including this peer.
+func (p *HTTPPool) Peers() []string {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if peer, nowport := p.peers.Get(peeraddr); peer != "" && peer != p.self {
-		p.Log("Pick peer %s", peer)
-		//nowpeer := &httpGetter{baseURL: peer}
-		return p.httpGetters[peer], nowport, peer
+	return append([]string(nil), p.members...)
+}
+
+// PickPeer picks the peer that owns key on the consistent hash ring.
+// It returns false when this peer is the owner.
+func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
+	peer, ok := p.owner(key)
+	if !ok {
+		return nil, false
 	}
-	return nil, "", ""
+	p.Log("Pick peer %s", peer.peer)
+	return peer, true
 }
 
-var _ PeerPicker = (*HTTPPool)(nil)
+// owner is PickPeer without the logging.
+func (p *HTTPPool) owner(key string) (*httpGetter, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil {
+		return nil, false
+	}
+	if peer := p.peers.GetforKey(key); peer != "" && peer != p.self {
+		return p.httpGetters[peer], true
+	}
+	return nil, false
+}
 
-type httpGetter struct {
-	baseURL string
+// PickReplicas returns the peers holding the n replicas of key: its owner
+// and the next n-1 peers on the consistent hash ring. A nil PeerGetter
+// stands for this peer.
+func (p *HTTPPool) PickReplicas(key string, n int) []PeerGetter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil {
+		return nil
+	}
+	addrs := p.peers.GetN(key, n)
+	replicas := make([]PeerGetter, len(addrs))
+	for i, addr := range addrs {
+		if addr != p.self {
+			replicas[i] = p.httpGetters[addr]
+		}
+	}
+	return replicas
 }
 
-func (h *httpGetter) Get(in *Request, out *Response) error {
-	u := fmt.Sprintf(
-		//"%v%v/%v",
-		"%v%v/%v?local=true",
-		h.baseURL,
-		url.QueryEscape(in.Group),
-		url.QueryEscape(in.Key),
-	)
-	res, err := http.Get(u)
-	fmt.Printf("Response: %+v, Error: %v\n", res, err)
-	if err != nil {
-		return err
+var _ ReplicaPicker = (*HTTPPool)(nil)
+
+// SetHandoffRate limits the rate at which the pool hands entries over to
+// their new owners to bytesPerSecond, 10 MiB/s by default. A rate <= 0
+// turns the limit off.
+func (p *HTTPPool) SetHandoffRate(bytesPerSecond int64) {
+	p.rebalance.setRate(bytesPerSecond)
+}
+
+// Drain takes this peer off its ring for good and hands every cached
+// entry over to the peer that owns it from then on, for a graceful
+// shutdown. It returns once all entries were sent or ctx is done.
+// Requests still reaching the peer are forwarded to the new owners.
+// The write-behind writes queued by the groups are flushed as well.
+func (p *HTTPPool) Drain(ctx context.Context) error {
+	p.mu.Lock()
+	p.draining = true
+	if _, ok := p.httpGetters[p.self]; ok {
+		delete(p.httpGetters, p.self)
+		p.peers.Remove(p.self)
+		i := sort.SearchStrings(p.members, p.self)
+		p.members = append(p.members[:i], p.members[i+1:]...)
 	}
-	defer res.Body.Close()
+	p.mu.Unlock()
+	err := p.rebalance.drain(ctx, func(ctx context.Context, t *throttle) error {
+		return p.handoffGroups(ctx, t)
+	})
+	for _, g := range p.registeredGroups() {
+		if ferr := g.Flush(ctx); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned: %v", res.Status)
+// handoff runs handoffGroups for the rebalancer.
+func (p *HTTPPool) handoff(ctx context.Context, t *throttle) {
+	if err := p.handoffGroups(ctx, t); err != nil && err != context.Canceled {
+		p.Log("handing off entries: %v", err)
 	}
+}
 
-	bytes, err := ioutil.ReadAll(res.Body)
-	fmt.Println("Body content:", string(bytes))
-	if err != nil {
-		return fmt.Errorf("reading response body: %v", err)
+// handoffGroups hands the entries of the groups registered with the pool
+// over to their owners.
+func (p *HTTPPool) handoffGroups(ctx context.Context, t *throttle) error {
+	for _, g := range p.registeredGroups() {
+		if err := g.handoff(ctx, p.PickReplicas, t); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	var data map[string]string
-	if err = json.Unmarshal(bytes, &data); err != nil {
-		return fmt.Errorf("decoding response body: %v", err)
+// registeredGroups returns the groups registered with RegisterPeers.
+func (p *HTTPPool) registeredGroups() []*Group {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	groups := make([]*Group, 0, len(p.groups))
+	for _, g := range p.groups {
+		groups = append(groups, g)
 	}
-	value, exists := data[in.Key]
-	if !exists {
-		return fmt.Errorf("key '%s' not found in the response", in.Key)
+	return groups
+}
+
+var _ PeerPicker = (*HTTPPool)(nil)
+
+type httpGetter struct {
+	baseURL string
+	// duration records the latency of requests to the peer
+	duration *metrics.HistogramVec
+	peer     string
+}
+
+// observe records the latency of an op started at start.
+func (h *httpGetter) observe(op string, start time.Time) {
+	if h.duration != nil {
+		h.duration.With(h.peer, op).ObserveSince(start)
 	}
-	fmt.Printf("Extracted value for key '%s': %s\n", in.Key, value)
-	out.Value = []byte(value)
+}
 
-	return nil
+func (h *httpGetter) Get(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	defer h.observe("get", time.Now())
+	return h.do(ctx, http.MethodGet, in, out)
 }
 
-func (h *httpGetter) Delete(in *Request) bool {
+func (h *httpGetter) Delete(ctx context.Context, in *pb.Request) (bool, error) {
+	defer h.observe("delete", time.Now())
+	out := &pb.DeleteResponse{}
+	if err := h.do(ctx, http.MethodDelete, in, out); err != nil {
+		return false, err
+	}
+	return out.Deleted, nil
+}
+
+func (h *httpGetter) Set(ctx context.Context, in *pb.Request) error {
+	defer h.observe("set", time.Now())
+	return h.do(ctx, http.MethodPost, in, &pb.SetResponse{})
+}
+
+// do sends in to the peer with method and decodes the answer into out,
+// see servePeer. A missing key returns ErrNotFound, with out decoded.
+func (h *httpGetter) do(ctx context.Context, method string, in *pb.Request, out proto.Message) error {
 	u := fmt.Sprintf(
-		"%v%v/%v?local=true",
+		"%v%v/%v",
 		h.baseURL,
-		url.QueryEscape(in.Group),
-		url.QueryEscape(in.Key),
+		url.PathEscape(in.Group),
+		url.PathEscape(in.Key),
 	)
-
-	log.Printf("now url is %s", u)
-	req, err := http.NewRequest(http.MethodDelete, u, nil)
-	fmt.Printf("REQ: %+v, Error: %v\n", req, err)
+	body, err := proto.Marshal(in)
 	if err != nil {
-		return false
+		return fmt.Errorf("encoding request: %v", err)
 	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", protobufContentType)
 	res, err := http.DefaultClient.Do(req)
-	fmt.Printf("Response: %+v, Error: %v\n", res, err)
-	bytes, err := ioutil.ReadAll(res.Body)
-	fmt.Println("Body content:", string(bytes))
-	deleteres := string(bytes)
 	if err != nil {
-		return false
+		return fmt.Errorf("sending request: %v", err)
 	}
 	defer res.Body.Close()
-	log.Printf("Response status code: %d, expected: %d", res.StatusCode, http.StatusOK)
-	return deleteres == "1"
-}
-
-func (h *httpGetter) Update(in *Request, data string) error {
-	u := fmt.Sprintf("%v", h.baseURL)
-	req, err := http.NewRequest(http.MethodPost, u, bytes.NewBufferString(data))
-	if err != nil {
-		log.Printf("Error creating HTTP request: %v", err)
+	notFound := res.StatusCode == http.StatusNotFound && isContentType(res.Header, protobufContentType)
+	if res.StatusCode != http.StatusOK && !notFound {
+		return fmt.Errorf("server returned: %v", res.Status)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	body, err = ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Fatalf("Error sending request: %v", err)
+		return fmt.Errorf("reading response body: %v", err)
 	}
-	defer resp.Body.Close()
-	return err
+	if err := proto.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("decoding response body: %v", err)
+	}
+	if notFound {
+		return ErrNotFound
+	}
+	return nil
 }
 
 var _ PeerGetter = (*httpGetter)(nil)
+
+// accepts reports whether the request's Accept header lists mediaType.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, v := range r.Header["Accept"] {
+		for _, part := range strings.Split(v, ",") {
+			if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isContentType reports whether the body of a request or response with
+// header h is of mediaType.
+func isContentType(h http.Header, mediaType string) bool {
+	mt, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mt == mediaType
+}
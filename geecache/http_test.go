@@ -0,0 +1,299 @@
+package geecache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	pb "geecache/geecachepb"
+	"geecache/gossip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRawValues(t *testing.T) {
+	groups, pools, stop := newTestCluster(2, "raw", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s not found", key)
+		}))
+	defer stop()
+
+	// Stored through the node that does not own the key.
+	key := remoteKey(groups[0])
+	value := []byte{0x89, 'P', 'N', 'G', 0, 0xff, '"', '\n'}
+	req, err := http.NewRequest(http.MethodPut, pools[0].self+"/raw/"+key+"?ttl=1m", bytes.NewReader(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("PUT status = %v", res.Status)
+	}
+
+	for _, pool := range pools {
+		req, err := http.NewRequest(http.MethodGet, pool.self+"/raw/"+key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/octet-stream")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/octet-stream" {
+			t.Errorf("%s: Content-Type = %q", pool.self, ct)
+		}
+		if !bytes.Equal(body, value) {
+			t.Errorf("%s: GET = %q, want %q", pool.self, body, value)
+		}
+	}
+
+	// Without the Accept header values are still served as JSON.
+	res, err = http.Get(pools[1].self + "/raw/" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Content-Type without Accept = %q", ct)
+	}
+
+	req, err = http.NewRequest(http.MethodPut, pools[0].self+"/raw/"+key+"?ttl=soon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("PUT with bad ttl: status %v, want 400", res.Status)
+	}
+}
+
+func TestPeerProtocol(t *testing.T) {
+	groups, pools, stop := newTestCluster(3, "peer-protocol", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}), WithReplication(Replication{N: 3}))
+	defer stop()
+	ctx := context.Background()
+
+	if err := groups[0].Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	var peers []PeerGetter
+	for _, peer := range pools[0].PickReplicas("k", 3) {
+		if peer != nil {
+			peers = append(peers, peer)
+		}
+	}
+	// Values come with their versions, tombstones as well.
+	for _, peer := range peers {
+		view, err := groups[0].getFromPeer(ctx, peer, "k", true)
+		if err != nil || view.String() != "v" || view.version == 0 {
+			t.Errorf("Get = %q version %d, %v; want v with a version", view.String(), view.version, err)
+		}
+	}
+	if _, err := groups[0].Delete(ctx, "k", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range peers {
+		view, err := groups[0].getFromPeer(ctx, peer, "k", false)
+		if !errors.Is(err, ErrNotFound) || view.version == 0 {
+			t.Errorf("Get of a deleted key = version %d, %v; want ErrNotFound with a version", view.version, err)
+		}
+	}
+
+	// An unknown group is not a missing key.
+	err := peers[0].Get(ctx, &pb.Request{Group: "no-such-group", Key: "k"}, &pb.Response{})
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Get from an unknown group: %v", err)
+	}
+
+	// Values past their soft TTL come marked stale.
+	groups, pools, stop = newTestCluster(2, "peer-protocol-stale", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return []byte("db " + key), nil
+		}), WithSoftTTL(20*time.Millisecond), WithTTL(time.Minute))
+	defer stop()
+	key := remoteKey(groups[0])
+	peer, _ := pools[0].PickPeer(key)
+	if view, err := groups[0].getFromPeer(ctx, peer, key, false); err != nil || view.stale {
+		t.Fatalf("Get = %q, stale %t, %v", view.String(), view.stale, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if view, err := groups[0].getFromPeer(ctx, peer, key, false); err != nil || !view.stale {
+		t.Errorf("Get past the soft TTL = %q, stale %t, %v; want stale", view.String(), view.stale, err)
+	}
+}
+
+func TestMembershipAPI(t *testing.T) {
+	groups, pools, stop := newTestCluster(3, "membership", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return []byte("db " + key), nil
+		}))
+	defer stop()
+	addrs := pools[0].Peers()
+
+	do := func(method, u string) {
+		t.Helper()
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: %v", method, u, res.Status)
+		}
+	}
+	expect := func(pool *HTTPPool, want ...string) {
+		t.Helper()
+		res, err := http.Get(pool.self + "/_peers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var got []string
+		if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s has peers %v, want %v", pool.self, got, want)
+		}
+	}
+
+	removed := pools[2].self
+	do(http.MethodDelete, pools[0].self+"/_peers?peer="+url.QueryEscape(removed))
+	var rest []string
+	for _, a := range addrs {
+		if a != removed {
+			rest = append(rest, a)
+		}
+	}
+	expect(pools[0], rest...)
+	expect(pools[1], rest...)
+	expect(pools[2], removed)
+	for i := 0; i < 100; i++ {
+		if peer, ok := pools[1].PickPeer(fmt.Sprint(i)); ok && peer.(*httpGetter).peer == removed {
+			t.Fatalf("key %d still routed to the removed peer", i)
+		}
+	}
+	if _, err := groups[2].Get(context.Background(), "k", false); err != nil {
+		t.Errorf("Get on the removed node: %v", err)
+	}
+
+	// Joining through another node brings everyone, and the new node, to
+	// the full membership.
+	do(http.MethodPost, pools[1].self+"/_peers?peer="+url.QueryEscape(removed))
+	for _, pool := range pools {
+		expect(pool, addrs...)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, pools[0].self+"/_peers?peer=cache-server-4", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("adding a bad address: %v, want 400", res.Status)
+	}
+}
+
+func TestGossipDropsCrashedPeer(t *testing.T) {
+	const n = 3
+	servers := make([]*httptest.Server, n)
+	pools := make([]*HTTPPool, n)
+	lists := make([]*gossip.Memberlist, n)
+	addrs := make([]string, n)
+	var down int32 // the last node fails every request while set
+	config := gossip.Config{
+		ProbeInterval:  20 * time.Millisecond,
+		ProbeTimeout:   10 * time.Millisecond,
+		SuspectTimeout: 100 * time.Millisecond,
+	}
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		addrs[i] = "http://" + servers[i].Listener.Addr().String()
+		pools[i] = NewHTTPPool(addrs[i])
+		servers[i].Config.Handler = pools[i]
+		defer servers[i].Close()
+	}
+	last := pools[n-1]
+	servers[n-1].Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		last.ServeHTTP(w, r)
+	})
+	for i, pool := range pools {
+		servers[i].Start()
+		pool.Set(addrs...)
+		lists[i] = pool.StartGossip(config)
+		defer lists[i].Stop()
+	}
+	waitPeers := func(pool *HTTPPool, want []string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for fmt.Sprint(pool.Peers()) != fmt.Sprint(want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s has peers %v, want %v", pool.self, pool.Peers(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	all := pools[0].Peers()
+	var survivors []string
+	for _, a := range all {
+		if a != last.self {
+			survivors = append(survivors, a)
+		}
+	}
+
+	// Crash the last node.
+	lists[n-1].Stop()
+	atomic.StoreInt32(&down, 1)
+	for _, pool := range pools[:n-1] {
+		waitPeers(pool, survivors)
+	}
+
+	// Restart it.
+	atomic.StoreInt32(&down, 0)
+	lists[n-1] = last.StartGossip(config)
+	defer lists[n-1].Stop()
+	for _, pool := range pools {
+		waitPeers(pool, all)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, addrs[0]+"/_peers?peer="+url.QueryEscape(addrs[1]), nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("DELETE /_peers with gossip: %v, want 409", res.Status)
+	}
+}
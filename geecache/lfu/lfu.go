@@ -0,0 +1,219 @@
+package lfu
+
+import (
+	"container/list"
+	"geecache/lru"
+	"time"
+)
+
+// Cache is a LFU cache bounded by bytes. It is not safe for concurrent access.
+// Among the least frequently used entries, the least recently used one is
+// evicted first.
+type Cache struct {
+	maxBytes int64
+	nbytes   int64
+	cache    map[string]*list.Element
+	// freqs holds one list per access count, most recent entry at the front
+	freqs   map[int]*list.List
+	minFreq int
+	// optional and executed when an entry is purged.
+	OnEvicted func(key string, value lru.Value, reason lru.EvictReason)
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+type entry struct {
+	key   string
+	value lru.Value
+	freq  int
+	// expire is the deadline of the entry, zero means it never expires
+	expire time.Time
+}
+
+// expired reports whether the entry's deadline has passed at t.
+func (e *entry) expired(t time.Time) bool {
+	return !e.expire.IsZero() && !t.Before(e.expire)
+}
+
+// New is the Constructor of Cache
+func New(maxBytes int64, onEvicted func(string, lru.Value, lru.EvictReason)) *Cache {
+	return &Cache{
+		maxBytes:  maxBytes,
+		cache:     make(map[string]*list.Element),
+		freqs:     make(map[int]*list.List),
+		OnEvicted: onEvicted,
+		now:       time.Now,
+	}
+}
+
+// Add adds a value to the cache.
+func (c *Cache) Add(key string, value lru.Value) {
+	c.AddWithTTL(key, value, 0)
+}
+
+// AddWithTTL adds a value to the cache that expires after ttl.
+// A ttl <= 0 means the value never expires.
+func (c *Cache) AddWithTTL(key string, value lru.Value, ttl time.Duration) {
+	var expire time.Time
+	if ttl > 0 {
+		expire = c.now().Add(ttl)
+	}
+	if ele, ok := c.cache[key]; ok {
+		kv := ele.Value.(*entry)
+		c.nbytes += int64(value.Len()) - int64(kv.value.Len())
+		kv.value = value
+		kv.expire = expire
+		c.touch(ele)
+	} else {
+		kv := &entry{key: key, value: value, freq: 1, expire: expire}
+		c.cache[key] = c.list(1).PushFront(kv)
+		c.minFreq = 1
+		c.nbytes += int64(len(key)) + int64(value.Len())
+	}
+	for c.maxBytes != 0 && c.maxBytes < c.nbytes {
+		c.RemoveLeastFrequent()
+	}
+}
+
+// Get look ups a key's value
+// An expired entry reads as a miss and is removed.
+func (c *Cache) Get(key string) (value lru.Value, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		kv := ele.Value.(*entry)
+		if kv.expired(c.now()) {
+			c.removeElement(ele, lru.EvictExpired)
+			return nil, false
+		}
+		c.touch(ele)
+		return kv.value, true
+	}
+	return
+}
+
+// Peek looks up a key's value like Get, without marking it used. An
+// expired entry reads as a miss but is left to be reclaimed.
+func (c *Cache) Peek(key string) (value lru.Value, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		if kv := ele.Value.(*entry); !kv.expired(c.now()) {
+			return kv.value, true
+		}
+	}
+	return
+}
+
+// Remove removes the key you need and reports whether it was present.
+// An expired entry is reclaimed but reported as absent.
+func (c *Cache) Remove(key string) bool {
+	if ele, hit := c.cache[key]; hit {
+		if ele.Value.(*entry).expired(c.now()) {
+			c.removeElement(ele, lru.EvictExpired)
+			return false
+		}
+		c.removeElement(ele, lru.EvictDeleted)
+		return true
+	}
+	return false
+}
+
+// RemoveLeastFrequent removes the least frequently used item
+func (c *Cache) RemoveLeastFrequent() {
+	if len(c.cache) == 0 {
+		return
+	}
+	l, ok := c.freqs[c.minFreq]
+	if !ok {
+		// minFreq is only a lower bound after removals, look for the real one.
+		c.minFreq = 0
+		for freq := range c.freqs {
+			if c.minFreq == 0 || freq < c.minFreq {
+				c.minFreq = freq
+			}
+		}
+		l = c.freqs[c.minFreq]
+	}
+	c.removeElement(l.Back(), lru.EvictCapacity)
+}
+
+// RemoveExpired removes every expired entry and returns how many were removed.
+func (c *Cache) RemoveExpired() int {
+	now := c.now()
+	removed := 0
+	for _, ele := range c.cache {
+		if ele.Value.(*entry).expired(now) {
+			c.removeElement(ele, lru.EvictExpired)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Range calls f for every entry that has not expired, with the time it
+// has left or 0 if it never expires, until f returns false. f must not
+// modify the cache.
+func (c *Cache) Range(f func(key string, value lru.Value, ttl time.Duration) bool) {
+	now := c.now()
+	for key, ele := range c.cache {
+		kv := ele.Value.(*entry)
+		if kv.expired(now) {
+			continue
+		}
+		var ttl time.Duration
+		if !kv.expire.IsZero() {
+			ttl = kv.expire.Sub(now)
+		}
+		if !f(key, kv.value, ttl) {
+			return
+		}
+	}
+}
+
+// Len the number of cache entries
+func (c *Cache) Len() int {
+	return len(c.cache)
+}
+
+// Bytes the number of bytes taken by keys and values
+func (c *Cache) Bytes() int64 {
+	return c.nbytes
+}
+
+// touch moves the entry to the list of its next access count.
+func (c *Cache) touch(ele *list.Element) {
+	kv := ele.Value.(*entry)
+	c.unlink(ele)
+	if kv.freq == c.minFreq && c.freqs[kv.freq] == nil {
+		c.minFreq++
+	}
+	kv.freq++
+	c.cache[kv.key] = c.list(kv.freq).PushFront(kv)
+}
+
+func (c *Cache) list(freq int) *list.List {
+	l, ok := c.freqs[freq]
+	if !ok {
+		l = list.New()
+		c.freqs[freq] = l
+	}
+	return l
+}
+
+// unlink takes the element out of its frequency list, dropping the list
+// once it is empty.
+func (c *Cache) unlink(ele *list.Element) {
+	freq := ele.Value.(*entry).freq
+	l := c.freqs[freq]
+	l.Remove(ele)
+	if l.Len() == 0 {
+		delete(c.freqs, freq)
+	}
+}
+
+func (c *Cache) removeElement(ele *list.Element, reason lru.EvictReason) {
+	kv := ele.Value.(*entry)
+	c.unlink(ele)
+	delete(c.cache, kv.key)
+	c.nbytes -= int64(len(kv.key)) + int64(kv.value.Len())
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value, reason)
+	}
+}
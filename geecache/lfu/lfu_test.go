@@ -0,0 +1,106 @@
+package lfu
+
+import (
+	"geecache/lru"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestGet(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.Add("key1", String("1234"))
+	if v, ok := lfu.Get("key1"); !ok || string(v.(String)) != "1234" {
+		t.Fatalf("cache hit key1=1234 failed")
+	}
+	if _, ok := lfu.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+}
+
+func TestPeek(t *testing.T) {
+	keys := make([]string, 0)
+	callback := func(key string, value lru.Value, reason lru.EvictReason) {
+		keys = append(keys, key)
+	}
+	lfu := New(int64(8), callback)
+	lfu.Add("k1", String("v1"))
+	lfu.Add("k2", String("v2"))
+	lfu.Get("k2")
+	for i := 0; i < 3; i++ {
+		if v, ok := lfu.Peek("k1"); !ok || string(v.(String)) != "v1" {
+			t.Fatalf("peek k1=v1 failed")
+		}
+	}
+	if _, ok := lfu.Peek("k3"); ok {
+		t.Fatalf("peek miss k3 failed")
+	}
+	// Peeks do not count as uses, so k1 is still the least frequent.
+	lfu.Add("k3", String("v3"))
+	if expect := []string{"k1"}; !reflect.DeepEqual(expect, keys) {
+		t.Fatalf("evicted %v, expect %v", keys, expect)
+	}
+}
+
+func TestRemoveLeastFrequent(t *testing.T) {
+	keys := make([]string, 0)
+	callback := func(key string, value lru.Value, reason lru.EvictReason) {
+		keys = append(keys, key)
+	}
+	lfu := New(int64(12), callback)
+	lfu.Add("k1", String("v1"))
+	lfu.Add("k2", String("v2"))
+	lfu.Add("k3", String("v3"))
+	lfu.Get("k1")
+	lfu.Get("k1")
+	lfu.Get("k3")
+	// k2 is the least frequently used, then k3.
+	lfu.Add("k4", String("v4"))
+	lfu.Add("k5", String("v5"))
+
+	expect := []string{"k2", "k4"}
+	if !reflect.DeepEqual(expect, keys) {
+		t.Fatalf("evicted %v, expect %v", keys, expect)
+	}
+	if lfu.Len() != 3 || lfu.Bytes() != 12 {
+		t.Fatalf("len=%d bytes=%d after evictions", lfu.Len(), lfu.Bytes())
+	}
+}
+
+func TestRemove(t *testing.T) {
+	lfu := New(int64(0), nil)
+	lfu.Add("key1", String("1234"))
+	lfu.Get("key1")
+	lfu.Add("key2", String("5678"))
+
+	if !lfu.Remove("key1") || lfu.Remove("key1") {
+		t.Fatalf("Remove key1 should succeed exactly once")
+	}
+	lfu.RemoveLeastFrequent()
+	if lfu.Len() != 0 || lfu.Bytes() != 0 {
+		t.Fatalf("len=%d bytes=%d after removing everything", lfu.Len(), lfu.Bytes())
+	}
+}
+
+func TestTTL(t *testing.T) {
+	now := time.Now()
+	lfu := New(int64(0), nil)
+	lfu.now = func() time.Time { return now }
+	lfu.AddWithTTL("key1", String("1"), time.Second)
+	lfu.AddWithTTL("key2", String("2"), time.Minute)
+
+	now = now.Add(time.Second)
+	if _, ok := lfu.Get("key1"); ok {
+		t.Fatalf("expired key1 should read as a miss")
+	}
+	now = now.Add(time.Minute)
+	if n := lfu.RemoveExpired(); n != 1 || lfu.Len() != 0 || lfu.Bytes() != 0 {
+		t.Fatalf("RemoveExpired removed %d, len=%d bytes=%d", n, lfu.Len(), lfu.Bytes())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"container/list"
 	//"fmt"
 	"sync"
+	"time"
 )
 
 // Cache is a LRU cache. It is not safe for concurrent access.
@@ -14,12 +15,45 @@ type Cache struct {
 	mu       sync.Mutex
 	cache    map[string]*list.Element
 	// optional and executed when an entry is purged.
-	OnEvicted func(key string, value Value)
+	OnEvicted func(key string, value Value, reason EvictReason)
+	// now returns the current time, replaced in tests
+	now func() time.Time
 }
 
 type entry struct {
 	key   string
 	value Value
+	// expire is the deadline of the entry, zero means it never expires
+	expire time.Time
+}
+
+// expired reports whether the entry's deadline has passed at t.
+func (e *entry) expired(t time.Time) bool {
+	return !e.expire.IsZero() && !t.Before(e.expire)
+}
+
+// EvictReason tells OnEvicted why an entry left the cache.
+type EvictReason int
+
+const (
+	// EvictDeleted means the entry was removed with Remove.
+	EvictDeleted EvictReason = iota
+	// EvictCapacity means the entry was dropped to stay within maxBytes.
+	EvictCapacity
+	// EvictExpired means the entry's TTL ran out.
+	EvictExpired
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictDeleted:
+		return "deleted"
+	case EvictCapacity:
+		return "capacity"
+	case EvictExpired:
+		return "expired"
+	}
+	return "unknown"
 }
 
 // Value use Len to count how many bytes it takes
@@ -28,24 +62,36 @@ type Value interface {
 }
 
 // New is the Constructor of Cache
-func New(maxBytes int64, onEvicted func(string, Value)) *Cache {
+func New(maxBytes int64, onEvicted func(string, Value, EvictReason)) *Cache {
 	return &Cache{
 		maxBytes:  maxBytes,
 		ll:        list.New(),
 		cache:     make(map[string]*list.Element),
 		OnEvicted: onEvicted,
+		now:       time.Now,
 	}
 }
 
 // Add adds a value to the cache.
 func (c *Cache) Add(key string, value Value) {
+	c.AddWithTTL(key, value, 0)
+}
+
+// AddWithTTL adds a value to the cache that expires after ttl.
+// A ttl <= 0 means the value never expires.
+func (c *Cache) AddWithTTL(key string, value Value, ttl time.Duration) {
+	var expire time.Time
+	if ttl > 0 {
+		expire = c.now().Add(ttl)
+	}
 	if ele, ok := c.cache[key]; ok {
 		c.ll.MoveToFront(ele)
 		kv := ele.Value.(*entry)
 		c.nbytes += int64(value.Len()) - int64(kv.value.Len())
 		kv.value = value
+		kv.expire = expire
 	} else {
-		ele := c.ll.PushFront(&entry{key, value})
+		ele := c.ll.PushFront(&entry{key: key, value: value, expire: expire})
 		c.cache[key] = ele
 		c.nbytes += int64(len(key)) + int64(value.Len())
 	}
@@ -55,41 +101,94 @@ func (c *Cache) Add(key string, value Value) {
 }
 
 // Get look ups a key's value
+// An expired entry reads as a miss and is removed.
 func (c *Cache) Get(key string) (value Value, ok bool) {
 	if ele, ok := c.cache[key]; ok {
-		c.ll.MoveToFront(ele)
 		kv := ele.Value.(*entry)
+		if kv.expired(c.now()) {
+			c.removeElement(ele, EvictExpired)
+			return nil, false
+		}
+		c.ll.MoveToFront(ele)
 		return kv.value, true
 	}
 	return
 }
 
-// Remove removes the key you need
-func (cache *Cache) Remove(key string) int {
-	if cache.cache == nil {
-		return 0
+// Peek looks up a key's value like Get, without marking it used. An
+// expired entry reads as a miss but is left to be reclaimed.
+func (c *Cache) Peek(key string) (value Value, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		if kv := ele.Value.(*entry); !kv.expired(c.now()) {
+			return kv.value, true
+		}
 	}
-	if ele, hit := cache.cache[key]; hit {
-		delete(cache.cache, key)
-		cache.nbytes -= int64(len(key)) + int64(ele.Value.(*entry).value.Len())
-		if cache.OnEvicted != nil {
-			cache.OnEvicted(key, ele.Value.(*entry).value)
+	return
+}
+
+// Remove removes the key you need and reports whether it was present.
+// An expired entry is reclaimed but reported as absent.
+func (c *Cache) Remove(key string) bool {
+	if ele, hit := c.cache[key]; hit {
+		if ele.Value.(*entry).expired(c.now()) {
+			c.removeElement(ele, EvictExpired)
+			return false
 		}
-		return 1
+		c.removeElement(ele, EvictDeleted)
+		return true
 	}
-	return 0
+	return false
 }
 
 // RemoveOldest removes the oldest item
 func (c *Cache) RemoveOldest() {
 	ele := c.ll.Back()
 	if ele != nil {
-		c.ll.Remove(ele)
+		c.removeElement(ele, EvictCapacity)
+	}
+}
+
+// RemoveExpired removes every expired entry and returns how many were removed.
+func (c *Cache) RemoveExpired() int {
+	now := c.now()
+	removed := 0
+	for ele := c.ll.Back(); ele != nil; {
+		prev := ele.Prev()
+		if ele.Value.(*entry).expired(now) {
+			c.removeElement(ele, EvictExpired)
+			removed++
+		}
+		ele = prev
+	}
+	return removed
+}
+
+func (c *Cache) removeElement(ele *list.Element, reason EvictReason) {
+	c.ll.Remove(ele)
+	kv := ele.Value.(*entry)
+	delete(c.cache, kv.key)
+	c.nbytes -= int64(len(kv.key)) + int64(kv.value.Len())
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value, reason)
+	}
+}
+
+// Range calls f for every entry that has not expired, with the time it
+// has left or 0 if it never expires, until f returns false. f must not
+// modify the cache.
+func (c *Cache) Range(f func(key string, value Value, ttl time.Duration) bool) {
+	now := c.now()
+	for key, ele := range c.cache {
 		kv := ele.Value.(*entry)
-		delete(c.cache, kv.key)
-		c.nbytes -= int64(len(kv.key)) + int64(kv.value.Len())
-		if c.OnEvicted != nil {
-			c.OnEvicted(kv.key, kv.value)
+		if kv.expired(now) {
+			continue
+		}
+		var ttl time.Duration
+		if !kv.expire.IsZero() {
+			ttl = kv.expire.Sub(now)
+		}
+		if !f(key, kv.value, ttl) {
+			return
 		}
 	}
 }
@@ -98,3 +197,8 @@ func (c *Cache) RemoveOldest() {
 func (c *Cache) Len() int {
 	return c.ll.Len()
 }
+
+// Bytes the number of bytes taken by keys and values
+func (c *Cache) Bytes() int64 {
+	return c.nbytes
+}
@@ -1,8 +1,12 @@
 package lru
 
 import (
+	"fmt"
+	"math/rand"
 	"reflect"
 	"testing"
+	"testing/quick"
+	"time"
 )
 
 type String string
@@ -22,6 +26,26 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestPeek(t *testing.T) {
+	now := time.Now()
+	lru := New(int64(len("key1"+"1234"+"key2"+"5678")), nil)
+	lru.now = func() time.Time { return now }
+	lru.Add("key1", String("1234"))
+	lru.AddWithTTL("key2", String("5678"), time.Second)
+	if v, ok := lru.Peek("key1"); !ok || string(v.(String)) != "1234" {
+		t.Fatalf("peek key1=1234 failed")
+	}
+	now = now.Add(time.Second)
+	if _, ok := lru.Peek("key2"); ok || lru.Len() != 2 {
+		t.Fatalf("expired key2 should peek as a miss and be kept")
+	}
+	// Peeking key1 did not make it recently used, so it goes first.
+	lru.Add("k3", String("v3"))
+	if _, ok := lru.Peek("key1"); ok {
+		t.Fatalf("key1 should have been evicted")
+	}
+}
+
 func TestRemoveoldest(t *testing.T) {
 	k1, k2, k3 := "key1", "key2", "k3"
 	v1, v2, v3 := "value1", "value2", "v3"
@@ -38,7 +62,7 @@ func TestRemoveoldest(t *testing.T) {
 
 func TestOnEvicted(t *testing.T) {
 	keys := make([]string, 0)
-	callback := func(key string, value Value) {
+	callback := func(key string, value Value, reason EvictReason) {
 		keys = append(keys, key)
 	}
 	lru := New(int64(10), callback)
@@ -63,3 +87,207 @@ func TestAdd(t *testing.T) {
 		t.Fatal("expected 6 but got", lru.nbytes)
 	}
 }
+
+func TestTTL(t *testing.T) {
+	now := time.Now()
+	lru := New(int64(0), nil)
+	lru.now = func() time.Time { return now }
+	lru.AddWithTTL("key1", String("1234"), time.Second)
+	lru.Add("key2", String("1234"))
+
+	if _, ok := lru.Get("key1"); !ok {
+		t.Fatalf("cache hit key1 before expiry failed")
+	}
+	now = now.Add(time.Second)
+	if _, ok := lru.Get("key1"); ok || lru.Len() != 1 {
+		t.Fatalf("expired key1 should read as a miss and be removed")
+	}
+	if _, ok := lru.Get("key2"); !ok {
+		t.Fatalf("key2 without ttl should never expire")
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	now := time.Now()
+	lru := New(int64(0), nil)
+	lru.now = func() time.Time { return now }
+	lru.AddWithTTL("key1", String("1"), time.Second)
+	lru.AddWithTTL("key2", String("2"), time.Minute)
+	lru.AddWithTTL("key3", String("3"), time.Second)
+
+	now = now.Add(2 * time.Second)
+	if n := lru.RemoveExpired(); n != 2 || lru.Len() != 1 {
+		t.Fatalf("RemoveExpired removed %d, %d left", n, lru.Len())
+	}
+	if lru.nbytes != int64(len("key2")+len("2")) {
+		t.Fatal("expected 5 bytes but got", lru.nbytes)
+	}
+}
+
+func TestRange(t *testing.T) {
+	now := time.Now()
+	lru := New(int64(0), nil)
+	lru.now = func() time.Time { return now }
+	lru.AddWithTTL("key1", String("1"), time.Second)
+	lru.AddWithTTL("key2", String("2"), time.Minute)
+	lru.Add("key3", String("3"))
+
+	now = now.Add(2 * time.Second)
+	got := make(map[string]time.Duration)
+	lru.Range(func(key string, value Value, ttl time.Duration) bool {
+		got[key] = ttl
+		return true
+	})
+	want := map[string]time.Duration{"key2": time.Minute - 2*time.Second, "key3": 0}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Range visited %v, want %v", got, want)
+	}
+
+	n := 0
+	lru.Range(func(key string, value Value, ttl time.Duration) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("Range went on after f returned false, %d calls", n)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("key1", String("1234"))
+	lru.Add("key2", String("5678"))
+
+	if !lru.Remove("key1") || lru.Remove("key1") {
+		t.Fatalf("Remove key1 should succeed exactly once")
+	}
+	if lru.Len() != 1 || lru.Bytes() != int64(len("key2")+len("5678")) {
+		t.Fatalf("Remove left len=%d bytes=%d", lru.Len(), lru.Bytes())
+	}
+	// key1 must be unlinked so RemoveOldest drops key2 and nothing else.
+	lru.RemoveOldest()
+	if lru.Len() != 0 || lru.Bytes() != 0 {
+		t.Fatalf("RemoveOldest after Remove left len=%d bytes=%d", lru.Len(), lru.Bytes())
+	}
+}
+
+func TestEvictReason(t *testing.T) {
+	now := time.Now()
+	reasons := make(map[string]EvictReason)
+	lru := New(int64(10), func(key string, value Value, reason EvictReason) {
+		reasons[key] = reason
+	})
+	lru.now = func() time.Time { return now }
+	lru.Add("k1", String("v1"))
+	lru.AddWithTTL("k2", String("v2"), time.Second)
+	lru.Remove("k1")
+	lru.Add("k3", String("v3"))
+	lru.Add("k4", String("v4"))
+	lru.Add("k5", String("v5"))
+	now = now.Add(time.Second)
+	lru.RemoveExpired()
+
+	expect := map[string]EvictReason{
+		"k1": EvictDeleted,
+		"k2": EvictCapacity,
+		"k3": EvictCapacity,
+	}
+	if !reflect.DeepEqual(expect, reasons) {
+		t.Fatalf("evict reasons = %v, expect %v", reasons, expect)
+	}
+
+	lru.AddWithTTL("k6", String("v6"), time.Second)
+	now = now.Add(time.Second)
+	lru.RemoveExpired()
+	if reasons["k6"] != EvictExpired {
+		t.Fatalf("k6 evicted for %v, expect %v", reasons["k6"], EvictExpired)
+	}
+}
+
+// op is one step of a random Add/Get/Remove workload.
+type op struct {
+	kind  int // 0 Add, 1 Get, 2 Remove
+	key   string
+	value String
+}
+
+type ops []op
+
+func (ops) Generate(r *rand.Rand, size int) reflect.Value {
+	s := make(ops, r.Intn(size*4+1))
+	for i := range s {
+		s[i] = op{
+			kind:  r.Intn(3),
+			key:   fmt.Sprintf("k%d", r.Intn(8)),
+			value: String(make([]byte, r.Intn(6))),
+		}
+	}
+	return reflect.ValueOf(s)
+}
+
+// TestProperties checks a random mix of Add/Get/Remove against a simple
+// model of an LRU: a slice ordered from oldest to newest.
+func TestProperties(t *testing.T) {
+	check := func(maxBytes uint8, s ops) bool {
+		lru := New(int64(maxBytes%40), nil)
+		var model []op
+		find := func(key string) int {
+			for i, m := range model {
+				if m.key == key {
+					return i
+				}
+			}
+			return -1
+		}
+		for _, o := range s {
+			i := find(o.key)
+			switch o.kind {
+			case 0:
+				lru.Add(o.key, o.value)
+				if i >= 0 {
+					model = append(model[:i], model[i+1:]...)
+				}
+				model = append(model, o)
+				for lru.maxBytes != 0 && modelBytes(model) > lru.maxBytes {
+					model = model[1:]
+				}
+			case 1:
+				v, ok := lru.Get(o.key)
+				if ok != (i >= 0) {
+					return false
+				}
+				if ok {
+					if v.(String) != model[i].value {
+						return false
+					}
+					m := model[i]
+					model = append(model[:i], model[i+1:]...)
+					model = append(model, m)
+				}
+			case 2:
+				if lru.Remove(o.key) != (i >= 0) {
+					return false
+				}
+				if i >= 0 {
+					model = append(model[:i], model[i+1:]...)
+				}
+			}
+			if lru.Len() != len(model) || lru.Len() != len(lru.cache) ||
+				lru.Bytes() != modelBytes(model) {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func modelBytes(model []op) int64 {
+	var n int64
+	for _, m := range model {
+		n += int64(len(m.key) + m.value.Len())
+	}
+	return n
+}
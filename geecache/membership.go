@@ -0,0 +1,204 @@
+package geecache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"geecache/gossip"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// servePeers serves the membership admin API at peersPath:
+//
+//	GET    /_peers                 list the members as a JSON array
+//	POST   /_peers?peer=<address>  add one or more members
+//	DELETE /_peers?peer=<address>  remove one or more members
+//	PUT    /_peers                 replace the members with a JSON array
+//
+// A change made through POST or DELETE is sent on to every node of the old
+// and the new membership as a PUT, so all of them converge on the same
+// view. Removed nodes are left with only themselves. Requests marked
+// local come from such a broadcast and are not sent on. Changes should be
+// made one at a time, concurrent ones may leave the nodes disagreeing.
+//
+// With gossip on, POST makes gossip join the peers and the membership
+// cannot be changed otherwise: nodes leave by shutting down.
+func (p *HTTPPool) servePeers(w http.ResponseWriter, r *http.Request, local bool) {
+	m := p.memberlist()
+	switch {
+	case r.Method == http.MethodGet:
+	case m != nil && r.Method == http.MethodPost:
+		peers := r.URL.Query()["peer"]
+		for _, peer := range peers {
+			if err := validPeer(peer); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		m.Join(peers...)
+	case m != nil:
+		http.Error(w, "membership is managed by gossip", http.StatusConflict)
+		return
+	case r.Method == http.MethodPost, r.Method == http.MethodDelete:
+		peers := r.URL.Query()["peer"]
+		if len(peers) == 0 {
+			http.Error(w, "peer is required", http.StatusBadRequest)
+			return
+		}
+		for _, peer := range peers {
+			if err := validPeer(peer); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		old := p.Peers()
+		if r.Method == http.MethodPost {
+			p.AddPeers(peers...)
+		} else {
+			p.RemovePeers(peers...)
+		}
+		members := p.Peers()
+		if !contains(members, p.self) {
+			p.Set(p.self)
+		}
+		if !local {
+			if err := p.broadcastPeers(r.Context(), old, members); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+	case r.Method == http.MethodPut:
+		var peers []string
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &peers)
+		}
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if !contains(peers, p.self) {
+			// Removed from the cluster, this node now serves on its own.
+			peers = []string{p.self}
+		}
+		p.Set(peers...)
+	default:
+		http.Error(w, "not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := json.Marshal(p.Peers())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// broadcastPeers sends the membership members to every other node of old
+// and members, and reports the nodes it could not reach.
+func (p *HTTPPool) broadcastPeers(ctx context.Context, old, members []string) error {
+	body, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	seen := map[string]bool{p.self: true}
+	for _, peer := range append(old, members...) {
+		if seen[peer] {
+			continue
+		}
+		seen[peer] = true
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if err := putPeers(ctx, peer+p.basePath+peersPath+"?local=true", body); err != nil {
+				p.Log("sending membership to %s: %v", peer, err)
+				mu.Lock()
+				failed = append(failed, peer)
+				mu.Unlock()
+			}
+		}(peer)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return fmt.Errorf("membership changed but not sent to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func putPeers(ctx context.Context, u string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	return nil
+}
+
+// validPeer checks that peer is the base URL of a node, e.g.
+// http://cache-server-4:9530.
+func validPeer(peer string) error {
+	u, err := url.Parse(peer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad peer address %q", peer)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// StartGossip runs SWIM gossip, see package gossip, between the pool's
+// current peers. From then on the ring holds the peers gossip does not
+// consider dead, so crashed peers drop out of it within seconds and come
+// back when they answer again. config.Transport defaults to HTTP through
+// the pool and config.OnChange is called after the ring changed.
+func (p *HTTPPool) StartGossip(config gossip.Config) *gossip.Memberlist {
+	if config.Transport == nil {
+		config.Transport = &gossip.HTTPTransport{Path: p.basePath + gossipPath}
+	}
+	onChange := config.OnChange
+	config.OnChange = func(members []string) {
+		p.Set(members...)
+		if onChange != nil {
+			onChange(members)
+		}
+	}
+	m := gossip.New(p.self, p.Peers(), config)
+	p.mu.Lock()
+	p.gossip = m
+	p.mu.Unlock()
+	m.Start()
+	return m
+}
+
+// memberlist returns the gossip member list, or nil if gossip is off.
+func (p *HTTPPool) memberlist() *gossip.Memberlist {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.gossip
+}
@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefBuckets are the default latency buckets, in seconds.
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets. It is safe for concurrent use.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // upper bounds, sorted
+	counts  []uint64  // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram returns a Histogram with the given bucket upper bounds.
+func NewHistogram(buckets []float64) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Histogram{buckets: b, counts: make([]uint64, len(b))}
+}
+
+// Observe adds one observation.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// ObserveSince observes the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Write writes the _bucket, _sum and _count samples of the histogram.
+// labels are name, value pairs added to every sample.
+func (h *Histogram) Write(w io.Writer, name string, labels ...string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	var cum uint64
+	for i, b := range h.buckets {
+		cum += counts[i]
+		WriteSample(w, name+"_bucket", float64(cum), append(labels, "le", formatFloat(b))...)
+	}
+	WriteSample(w, name+"_bucket", float64(count), append(labels, "le", "+Inf")...)
+	WriteSample(w, name+"_sum", sum, labels...)
+	WriteSample(w, name+"_count", float64(count), labels...)
+}
+
+// A CounterVec is a family of counters partitioned by label values.
+// It is safe for concurrent use.
+type CounterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]*counter // keyed by joined label values
+}
+
+type counter struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounterVec returns a CounterVec with the given label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*counter)}
+}
+
+// Add adds v to the counter of the label values, given in the order of
+// the label names.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, ok := c.values[key]
+	if !ok {
+		ctr = &counter{labelValues: append([]string(nil), labelValues...)}
+		c.values[key] = ctr
+	}
+	ctr.value += v
+}
+
+// Write writes the counter family in the text exposition format.
+func (c *CounterVec) Write(w io.Writer) {
+	WriteHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ctr := c.values[key]
+		WriteSample(w, c.name, ctr.value, pairs(c.labels, ctr.labelValues)...)
+	}
+}
+
+// A HistogramVec is a family of histograms partitioned by label values.
+// It is safe for concurrent use.
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*labeledHistogram // keyed by joined label values
+}
+
+type labeledHistogram struct {
+	labelValues []string
+	*Histogram
+}
+
+// NewHistogramVec returns a HistogramVec with the given buckets and label names.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: buckets,
+		values: make(map[string]*labeledHistogram)}
+}
+
+// With returns the histogram of the label values, given in the order of
+// the label names.
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lh, ok := h.values[key]
+	if !ok {
+		lh = &labeledHistogram{append([]string(nil), labelValues...), NewHistogram(h.buckets)}
+		h.values[key] = lh
+	}
+	return lh.Histogram
+}
+
+// Write writes the histogram family in the text exposition format.
+func (h *HistogramVec) Write(w io.Writer) {
+	WriteHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]*labeledHistogram, len(keys))
+	for i, key := range keys {
+		values[i] = h.values[key]
+	}
+	h.mu.Unlock()
+	for _, lh := range values {
+		lh.Write(w, h.name, pairs(h.labels, lh.labelValues)...)
+	}
+}
+
+// WriteHeader writes the HELP and TYPE lines of a metric family.
+func WriteHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, escape(help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// WriteSample writes one sample line. labels are name, value pairs.
+func WriteSample(w io.Writer, name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(escape(labels[i+1], true))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+// escape escapes backslashes and newlines, and double quotes in label values.
+func escape(s string, quote bool) string {
+	r := []string{`\`, `\\`, "\n", `\n`}
+	if quote {
+		r = append(r, `"`, `\"`)
+	}
+	return strings.NewReplacer(r...).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// pairs interleaves label names and values.
+func pairs(names, values []string) []string {
+	p := make([]string, 0, 2*len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		p = append(p, name, v)
+	}
+	return p
+}
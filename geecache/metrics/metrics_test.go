@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("requests_total", "Requests served.", "method", "path")
+	c.Add(1, "GET", "/a")
+	c.Add(2, "GET", "/a")
+	c.Add(1, "POST", `/"b"`)
+
+	var b strings.Builder
+	c.Write(&b)
+	expect := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{method="GET",path="/a"} 3
+requests_total{method="POST",path="/\"b\""} 1
+`
+	if b.String() != expect {
+		t.Fatalf("got\n%s\nexpect\n%s", b.String(), expect)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	h.With("get").Observe(0.05)
+	h.With("get").Observe(0.5)
+	h.With("get").Observe(5)
+
+	var b strings.Builder
+	h.Write(&b)
+	expect := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="get",le="0.1"} 1
+latency_seconds_bucket{op="get",le="1"} 2
+latency_seconds_bucket{op="get",le="+Inf"} 3
+latency_seconds_sum{op="get"} 5.55
+latency_seconds_count{op="get"} 3
+`
+	if b.String() != expect {
+		t.Fatalf("got\n%s\nexpect\n%s", b.String(), expect)
+	}
+}
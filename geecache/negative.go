@@ -0,0 +1,51 @@
+package geecache
+
+import "time"
+
+// defaultNegativeTTL is how long a key the Getter reported missing is
+// remembered unless set otherwise.
+const defaultNegativeTTL = 5 * time.Second
+
+// WithNegativeTTL sets how long the group remembers that a key does not
+// exist, 5 seconds by default, or turns negative caching off with 0.
+// Until then Get answers ErrNotFound without asking the Getter. A peer
+// that asked the owner remembers the answer only in its hot cache, see
+// WithHotCache, as the owner does not invalidate it when the key is
+// created through another peer.
+func WithNegativeTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.negativeTTL = ttl
+	}
+}
+
+// cacheNotFound adds a negative entry for key to the main cache.
+func (g *Group) cacheNotFound(key string) {
+	if g.negativeTTL > 0 {
+		g.mainCache.add(key, ByteView{notFound: true}, g.negativeTTL)
+	}
+}
+
+// cacheNotFoundHot adds a negative entry for key, owned by another peer,
+// to the hot cache. It lasts the shorter of the negative and hot TTLs.
+func (g *Group) cacheNotFoundHot(key string) {
+	if g.hot == nil || g.negativeTTL <= 0 {
+		return
+	}
+	ttl := g.negativeTTL
+	if g.hot.TTL < ttl {
+		ttl = g.hot.TTL
+	}
+	g.hotCache.add(key, ByteView{notFound: true}, ttl)
+}
+
+// cacheHit returns Get's answer for a value found in a cache, which is
+// ErrNotFound for a negative entry. The answer keeps the version of a
+// tombstone left by a replicated delete.
+func (g *Group) cacheHit(v ByteView) (ByteView, Source, error) {
+	g.Stats.CacheHits.Add(1)
+	if v.notFound {
+		g.Stats.NegativeHits.Add(1)
+		return ByteView{version: v.version}, FromCache, ErrNotFound
+	}
+	return v, FromCache, nil
+}
@@ -0,0 +1,121 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	var calls int32
+	groups, _, stop := newTestCluster(2, "negative", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}), WithNegativeTTL(100*time.Millisecond), WithHotCache(HotCacheConfig{Bytes: 1 << 20}))
+	defer stop()
+	ctx := context.Background()
+	key := remoteKey(groups[0])
+
+	for i := 0; i < 3; i++ {
+		if _, err := groups[0].Get(ctx, key, false); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get %d: err %v, want ErrNotFound", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("getter called %d times, want 1", n)
+	}
+	if n := groups[1].Stats.ServerRequests.Get(); n != 1 {
+		t.Errorf("owner served %d requests, want 1", n)
+	}
+	if n := groups[0].Stats.NegativeHits.Get(); n != 2 {
+		t.Errorf("NegativeHits = %d, want 2", n)
+	}
+
+	// A write through the asking peer replaces its negative entry.
+	if err := groups[0].Set(ctx, key, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := groups[0].Get(ctx, key, false); err != nil || view.String() != "v" {
+		t.Fatalf("Get after Set = %q, %v; want v", view.String(), err)
+	}
+
+	groups[0].Delete(ctx, key, false)
+	groups[0].Get(ctx, key, false)
+	time.Sleep(150 * time.Millisecond)
+	if _, err := groups[0].Get(ctx, key, false); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after the negative TTL: err %v, want ErrNotFound", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("getter called %d times after the negative TTL, want 3", n)
+	}
+	if n, err := groups[0].Delete(ctx, key, false); err != nil || n != 0 {
+		t.Errorf("Delete of a missing key = %d, %v; want 0", n, err)
+	}
+}
+
+func TestNegativeCacheOnOwner(t *testing.T) {
+	groups, _, stop := newTestCluster(3, "negative-owner", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}))
+	defer stop()
+	ctx := context.Background()
+	key := remoteKey(groups[0])
+	setter := 1
+	if _, ok := groups[1].peers.PickPeer(key); !ok {
+		setter = 2 // groups[1] owns key
+	}
+
+	if _, err := groups[0].Get(ctx, key, false); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get: err %v, want ErrNotFound", err)
+	}
+	// Without a hot cache the asking peer keeps no negative entry, so a
+	// key created through a third peer is found at once.
+	if err := groups[setter].Set(ctx, key, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if view, err := groups[0].Get(ctx, key, false); err != nil || view.String() != "v" {
+		t.Errorf("Get after a Set through another peer = %q, %v; want v", view.String(), err)
+	}
+}
+
+func TestTransientErrorsNotCached(t *testing.T) {
+	var calls int32
+	groups, pools, stop := newTestCluster(1, "transient", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			if key == "missing" {
+				return nil, ErrNotFound
+			}
+			return nil, errors.New("database unavailable")
+		}))
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		if _, err := groups[0].Get(context.Background(), "k", false); err == nil || errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get %d: err %v, want the getter's error", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("getter called %d times, want 3", n)
+	}
+	if n := groups[0].Stats.LocalLoadErrs.Get(); n != 3 {
+		t.Errorf("LocalLoadErrs = %d, want 3", n)
+	}
+
+	for key, want := range map[string]int{"missing": http.StatusNotFound, "k": http.StatusBadGateway} {
+		res, err := http.Get(pools[0].self + "/transient/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("GET %s: status %v, want %d", key, res.Status, want)
+		}
+	}
+}
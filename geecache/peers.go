@@ -1,14 +1,86 @@
 package geecache
 
+import (
+	"context"
+	pb "geecache/geecachepb"
+	"time"
+)
+
 // PeerPicker is the interface that must be implemented to locate
 // the peer that owns a specific key.
 type PeerPicker interface {
-	PickPeer(key string) (peer PeerGetter, nowport string, nowpeer string)
+	PickPeer(key string) (peer PeerGetter, ok bool)
+}
+
+// ReplicaPicker is implemented by a PeerPicker that can also locate the
+// replicas of a key, as WithReplication needs.
+type ReplicaPicker interface {
+	PeerPicker
+	// PickReplicas returns the peers holding the n replicas of key, its
+	// owner first. A nil PeerGetter stands for this peer. Fewer are
+	// returned when there are fewer peers.
+	PickReplicas(key string, n int) []PeerGetter
 }
 
 // PeerGetter is the interface that must be implemented by a peer.
+// Calls should give up once ctx is done.
 type PeerGetter interface {
-	Get(in *Request, out *Response) error
-	Delete(in *Request) bool
-	Update(in *Request, data string) error
+	Get(ctx context.Context, in *pb.Request, out *pb.Response) error
+	Delete(ctx context.Context, in *pb.Request) (bool, error)
+	Set(ctx context.Context, in *pb.Request) error
+}
+
+// BatchPeerGetter is implemented by a PeerGetter that can also send
+// several requests in one, as GetMany, SetMany and DeleteMany do. The
+// response holds a result for every request, in the same order.
+type BatchPeerGetter interface {
+	PeerGetter
+	GetMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error)
+	SetMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error)
+	DeleteMany(ctx context.Context, in *pb.BatchRequest) (*pb.BatchResponse, error)
+}
+
+// servePeerGet serves a Get sent by a peer, on this node and never
+// forwarded. A replica read is answered from the cache without loading.
+// With ErrNotFound, the response holds the version of the key's tombstone.
+func (g *Group) servePeerGet(ctx context.Context, in *pb.Request) (*pb.Response, Source, error) {
+	if in.Replica {
+		view, err := g.getReplica(in.Key)
+		return &pb.Response{Value: view.ByteSlice(), Version: view.version}, FromCache, err
+	}
+	view, source, err := g.GetWithSource(ctx, in.Key, true)
+	return &pb.Response{Value: view.ByteSlice(), Version: view.version, Stale: view.stale}, source, err
+}
+
+// servePeerSet serves a Set sent by a peer. Handed off values and
+// replicas are only cached, other values are added like Add.
+func (g *Group) servePeerSet(ctx context.Context, in *pb.Request) error {
+	ttl := time.Duration(in.TtlMs) * time.Millisecond
+	value := ByteView{b: in.Value, version: in.Version}
+	switch {
+	case in.Handoff:
+		g.takeHandoff(in.Key, value, ttl, time.Duration(in.FreshMs)*time.Millisecond)
+		return nil
+	case in.Replica:
+		g.takeReplica(in.Key, value, ttl)
+		return nil
+	}
+	return g.Add(ctx, in.Key, value, ttl, true)
+}
+
+// servePeerDelete serves a Delete sent by a peer and reports whether the
+// key was deleted. A replica is only deleted from the cache, a delete
+// with a version is a replicated delete on the key's owner.
+func (g *Group) servePeerDelete(ctx context.Context, in *pb.Request) (bool, error) {
+	if in.Replica {
+		return g.deleteReplica(in.Key, in.Version) > 0, nil
+	}
+	var n int
+	var err error
+	if in.Version != 0 {
+		n, err = g.deleteOwned(ctx, in.Key, in.Version)
+	} else {
+		n, err = g.Delete(ctx, in.Key, true)
+	}
+	return n > 0, err
 }
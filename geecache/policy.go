@@ -0,0 +1,58 @@
+package geecache
+
+import (
+	"geecache/arc"
+	"geecache/lfu"
+	"geecache/lru"
+	"geecache/tinylfu"
+	"time"
+)
+
+// A Policy decides which entries a cache evicts to stay within its
+// byte budget. Implementations need not be safe for concurrent access.
+type Policy interface {
+	AddWithTTL(key string, value lru.Value, ttl time.Duration)
+	Get(key string) (value lru.Value, ok bool)
+	// Peek is like Get but leaves the entry's recency and frequency as
+	// they are, for lookups that are not uses of the entry.
+	Peek(key string) (value lru.Value, ok bool)
+	Remove(key string) bool
+	RemoveExpired() int
+	// Range calls f for every unexpired entry with the time it has left,
+	// 0 if it never expires, until f returns false.
+	Range(f func(key string, value lru.Value, ttl time.Duration) bool)
+	Len() int
+	Bytes() int64
+}
+
+// A PolicyFunc creates a Policy holding at most maxBytes, 0 meaning no limit.
+type PolicyFunc func(maxBytes int64, onEvicted func(string, lru.Value, lru.EvictReason)) Policy
+
+// The eviction policies shipped with geecache.
+var (
+	// LRU evicts the least recently used entry.
+	LRU PolicyFunc = func(maxBytes int64, onEvicted func(string, lru.Value, lru.EvictReason)) Policy {
+		return lru.New(maxBytes, onEvicted)
+	}
+	// LFU evicts the least frequently used entry.
+	LFU PolicyFunc = func(maxBytes int64, onEvicted func(string, lru.Value, lru.EvictReason)) Policy {
+		return lfu.New(maxBytes, onEvicted)
+	}
+	// ARC balances recency and frequency and resists scans.
+	ARC PolicyFunc = func(maxBytes int64, onEvicted func(string, lru.Value, lru.EvictReason)) Policy {
+		return arc.New(maxBytes, onEvicted)
+	}
+	// TinyLFU only admits entries seen more often than the ones they
+	// would replace, and resists scans.
+	TinyLFU PolicyFunc = func(maxBytes int64, onEvicted func(string, lru.Value, lru.EvictReason)) Policy {
+		return tinylfu.New(maxBytes, onEvicted)
+	}
+)
+
+// WithPolicy sets the eviction policy of the group's caches, LRU by default.
+func WithPolicy(policy PolicyFunc) GroupOption {
+	return func(g *Group) {
+		g.mainCache.newPolicy = policy
+		g.hotCache.newPolicy = policy
+	}
+}
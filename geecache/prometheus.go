@@ -0,0 +1,107 @@
+package geecache
+
+import (
+	"bytes"
+	"geecache/lru"
+	"geecache/metrics"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// statusWriter remembers the status code written to a ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// groupLabel returns the group a request is for, as a metrics label.
+// Unknown groups get an empty label so that made-up names cannot grow
+// the number of series.
+func (p *HTTPPool) groupLabel(r *http.Request) string {
+	rest := r.URL.Path[len(p.basePath):]
+	if rest == statsPath || rest == metricsPath {
+		return rest
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	name := ""
+	if len(parts) == 2 || r.Method == http.MethodPost {
+		name = parts[0]
+	}
+	if g := p.lookupGroup(name); g != nil {
+		return g.name
+	}
+	return ""
+}
+
+// serveMetrics writes the metrics of the pool and of every group it
+// serves in the Prometheus text exposition format.
+func (p *HTTPPool) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "not supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var b bytes.Buffer
+	p.requests.Write(&b)
+	p.requestDuration.Write(&b)
+	p.peerDuration.Write(&b)
+
+	all := p.allGroups()
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics.WriteHeader(&b, "geecache_getter_duration_seconds", "Time of Getter calls, by group.", "histogram")
+	for _, name := range names {
+		all[name].getterDuration.Write(&b, "geecache_getter_duration_seconds", "group", name)
+	}
+	metrics.WriteHeader(&b, "geecache_cache_bytes", "Bytes held by a cache, by group and cache.", "gauge")
+	for _, name := range names {
+		for _, c := range all[name].labeledCaches() {
+			metrics.WriteSample(&b, "geecache_cache_bytes", float64(c.stats().Bytes), "group", name, "cache", c.label)
+		}
+	}
+	metrics.WriteHeader(&b, "geecache_cache_items", "Items held by a cache, by group and cache.", "gauge")
+	for _, name := range names {
+		for _, c := range all[name].labeledCaches() {
+			metrics.WriteSample(&b, "geecache_cache_items", float64(c.stats().Items), "group", name, "cache", c.label)
+		}
+	}
+	metrics.WriteHeader(&b, "geecache_cache_evictions_total", "Entries removed from a cache, by group, cache and reason.", "counter")
+	for _, name := range names {
+		for _, c := range all[name].labeledCaches() {
+			ev := c.evictions()
+			for _, reason := range []lru.EvictReason{lru.EvictDeleted, lru.EvictCapacity, lru.EvictExpired} {
+				metrics.WriteSample(&b, "geecache_cache_evictions_total", float64(ev[reason]),
+					"group", name, "cache", c.label, "reason", reason.String())
+			}
+		}
+	}
+	metrics.WriteHeader(&b, "geecache_singleflight_deduplicated_total", "Loads that waited for a concurrent load of the same key, by group.", "counter")
+	for _, name := range names {
+		st := &all[name].Stats
+		metrics.WriteSample(&b, "geecache_singleflight_deduplicated_total",
+			float64(st.Loads.Get()-st.LoadsDeduped.Get()), "group", name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// labeledCache is one of a group's caches with its metrics label.
+type labeledCache struct {
+	label string
+	*cache
+}
+
+// labeledCaches returns the caches of g.
+func (g *Group) labeledCaches() []labeledCache {
+	return []labeledCache{{"main", &g.mainCache}, {"hot", &g.hotCache}}
+}
@@ -0,0 +1,62 @@
+package geecache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServeMetrics(t *testing.T) {
+	groups, pools, stop := newTestCluster(2, "metrics", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return []byte("db " + key), nil
+		}))
+	defer stop()
+	for i := 0; i < 10; i++ {
+		groups[0].Get(context.Background(), fmt.Sprint(i), false)
+	}
+	// The ring may give all of those to groups[0].
+	groups[0].Get(context.Background(), remoteKey(groups[0]), false)
+	// Served by pools[1] for the keys it owns, which shows up there.
+	res, err := http.Get(pools[1].self + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	for _, line := range []string{
+		"# TYPE geecache_http_requests_total counter",
+		`geecache_http_requests_total{method="GET",group="metrics",code="200"} `,
+		`geecache_http_request_duration_seconds_count{method="GET",group="metrics"} `,
+		`geecache_getter_duration_seconds_bucket{group="metrics",le="+Inf"} `,
+		`geecache_cache_items{group="metrics",cache="main"} `,
+		`geecache_cache_evictions_total{group="metrics",cache="main",reason="capacity"} 0`,
+		`geecache_singleflight_deduplicated_total{group="metrics"} 0`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metrics lack %q", line)
+		}
+	}
+
+	// The peer requests were made by pools[0].
+	res, err = http.Get(pools[0].self + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ = ioutil.ReadAll(res.Body)
+	line := fmt.Sprintf(`geecache_peer_request_duration_seconds_count{peer=%q,op="get"} `, pools[1].self)
+	if !strings.Contains(string(body), line) {
+		t.Errorf("metrics lack %q", line)
+	}
+}
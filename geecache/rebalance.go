@@ -0,0 +1,215 @@
+package geecache
+
+import (
+	"context"
+	pb "geecache/geecachepb"
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultHandoffRate is the rate, in bytes per second, at which a pool
+// hands entries over to their new owners unless set otherwise.
+const defaultHandoffRate = 10 << 20
+
+// A rebalancer hands the cached entries a peer no longer owns over to
+// their new owners after the ring changed. It is shared by HTTPPool and
+// GRPCPool, which run it on every membership change.
+type rebalancer struct {
+	mu sync.Mutex
+	// rate is in bytes per second, <= 0 meaning unthrottled
+	rate int64
+	// cancel stops the running handoff, which closes done when it returns
+	cancel context.CancelFunc
+	done   chan struct{}
+	// draining is set by drain, after which start does nothing
+	draining bool
+}
+
+// setRate sets the handoff rate in bytes per second.
+func (r *rebalancer) setRate(bytesPerSecond int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rate = bytesPerSecond
+}
+
+// start runs fn in the background, once the handoff it replaces, which it
+// cancels, has returned. It does not block, so it may be called with the
+// pool's lock held.
+func (r *rebalancer) start(fn func(ctx context.Context, t *throttle)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return
+	}
+	if r.cancel != nil {
+		r.cancel()
+	}
+	prev := r.done
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	r.cancel, r.done = cancel, done
+	t := &throttle{rate: r.rate}
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		fn(ctx, t)
+	}()
+}
+
+// drain cancels the running handoff and runs fn instead, returning once
+// it has. Later calls of start are ignored.
+func (r *rebalancer) drain(ctx context.Context, fn func(ctx context.Context, t *throttle) error) error {
+	r.mu.Lock()
+	r.draining = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+	prev := r.done
+	t := &throttle{rate: r.rate}
+	r.mu.Unlock()
+	if prev != nil {
+		select {
+		case <-prev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fn(ctx, t)
+}
+
+// wait waits for the running handoff, if any, to return.
+func (r *rebalancer) wait() {
+	r.mu.Lock()
+	done := r.done
+	r.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// A throttle paces a stream of bytes to rate bytes per second.
+type throttle struct {
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+// wait accounts for n more bytes and sleeps until sending them keeps the
+// stream within the rate, or until ctx is done.
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.rate <= 0 {
+		return nil
+	}
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	t.sent += int64(n)
+	due := t.start.Add(time.Duration(float64(t.sent) / float64(t.rate) * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handoff sends every entry of the main cache this peer no longer holds a
+// replica of, according to pick, on to the key's owner, and drops it
+// here. Entries the owner could not take are dropped all the same, it
+// loads them again when asked.
+func (g *Group) handoff(ctx context.Context, pick func(key string, n int) []PeerGetter, t *throttle) error {
+	n := 1
+	if g.replication != nil {
+		n = g.replication.N
+	}
+	for _, e := range g.mainCache.entries() {
+		replicas := pick(e.key, n)
+		if len(replicas) == 0 || holdsReplica(replicas) {
+			continue
+		}
+		peer := replicas[0]
+		if err := t.wait(ctx, len(e.key)+e.value.Len()); err != nil {
+			return err
+		}
+		// The value keeps its deadlines rather than the cache's TTL,
+		// which has the WithStaleOnError grace added.
+		now := time.Now()
+		var ttl time.Duration
+		if !e.value.expires.IsZero() {
+			ttl = e.value.expires.Sub(now)
+		}
+		if e.value.notFound || !e.value.expires.IsZero() && ttl < time.Millisecond {
+			// It expires before it arrives, or the owner has to find out
+			// that the key is missing itself.
+			g.mainCache.remove(e.key)
+			continue
+		}
+		var freshMs int64
+		if !e.value.fresh.IsZero() {
+			if freshMs = int64(e.value.fresh.Sub(now) / time.Millisecond); freshMs == 0 {
+				freshMs = -1
+			}
+		}
+		req := &pb.Request{
+			Group:   g.name,
+			Key:     e.key,
+			Value:   e.value.ByteSlice(),
+			TtlMs:   int64(ttl / time.Millisecond),
+			Handoff: true,
+			Version: e.value.version,
+			FreshMs: freshMs,
+		}
+		if err := peer.Set(ctx, req); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			g.Stats.HandoffErrs.Add(1)
+			log.Println("[GeeCache] Failed to hand off", e.key, err)
+		} else {
+			g.Stats.KeysHandedOff.Add(1)
+		}
+		g.mainCache.remove(e.key)
+	}
+	return nil
+}
+
+// holdsReplica reports whether this peer, a nil PeerGetter, is among
+// replicas.
+func holdsReplica(replicas []PeerGetter) bool {
+	for _, peer := range replicas {
+		if peer == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// takeHandoff caches a value handed over by the key's previous owner,
+// with the hard TTL ttl and the soft one fresh it had left there, see
+// Request.FreshMs. A value cached here already is at least as new and is
+// kept. The value is not written to the store, which has it already.
+func (g *Group) takeHandoff(key string, value ByteView, ttl, fresh time.Duration) {
+	if ttl == 0 {
+		ttl = g.ttl
+	}
+	value, ttl = g.stamp(value, ttl)
+	value.fresh = time.Time{}
+	if fresh != 0 {
+		value.fresh = time.Now().Add(fresh)
+	}
+	if g.mainCache.addIfAbsent(key, value, ttl) {
+		g.Stats.KeysTakenOver.Add(1)
+	}
+}
@@ -0,0 +1,218 @@
+package geecache
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingGetter returns a getter that counts its calls in calls.
+func countingGetter(calls *int32) Getter {
+	return GetterFunc(func(ctx context.Context, key string) ([]byte, error) {
+		atomic.AddInt32(calls, 1)
+		return []byte("db " + key), nil
+	})
+}
+
+// cachedOn returns the indexes of the groups caching a value of key,
+// negative entries not counting.
+func cachedOn(groups []*Group, key string) []int {
+	var on []int
+	for i, g := range groups {
+		for _, e := range g.mainCache.entries() {
+			if e.key == key && !e.value.notFound {
+				on = append(on, i)
+			}
+		}
+	}
+	return on
+}
+
+// ownerIndex returns the index of the pool owning key.
+func ownerIndex(pools []*HTTPPool, key string) int {
+	for i, pool := range pools {
+		if _, ok := pool.owner(key); !ok {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestRebalanceOnJoin(t *testing.T) {
+	var calls int32
+	groups, pools, stop := newTestCluster(3, "rebalance-join", countingGetter(&calls))
+	defer stop()
+	all := pools[0].Peers()
+	joiner := pools[2].self
+	// Only the first two nodes know of each other to begin with.
+	for _, pool := range pools {
+		pool.SetHandoffRate(0)
+	}
+	pools[0].Set(pools[0].self, pools[1].self)
+	pools[1].Set(pools[0].self, pools[1].self)
+	ctx := context.Background()
+	const n = 200
+	for i := 0; i < n; i++ {
+		if _, err := groups[0].Get(ctx, fmt.Sprint(i), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, pool := range pools {
+		pool.Set(all...)
+	}
+	for _, pool := range pools {
+		pool.rebalance.wait()
+	}
+	moved := 0
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint(i)
+		owner := ownerIndex(pools, key)
+		if pools[owner].self == joiner {
+			moved++
+		}
+		if on := cachedOn(groups, key); len(on) != 1 || on[0] != owner {
+			t.Errorf("key %s cached on %v, want only its owner %d", key, on, owner)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no key moved to the new node")
+	}
+	var handedOff, takenOver int64
+	for _, g := range groups {
+		handedOff += g.Stats.KeysHandedOff.Get()
+		takenOver += g.Stats.KeysTakenOver.Get()
+	}
+	if handedOff != int64(moved) || takenOver != int64(moved) {
+		t.Errorf("%d keys handed off and %d taken over, want %d", handedOff, takenOver, moved)
+	}
+
+	for i := 0; i < n; i++ {
+		if _, err := groups[1].Get(ctx, fmt.Sprint(i), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := atomic.LoadInt32(&calls); calls != n {
+		t.Errorf("getter called %d times, want %d: moved keys were loaded again", calls, n)
+	}
+}
+
+func TestHandoffKeepsDeadlines(t *testing.T) {
+	var calls int32
+	groups, pools, stop := newTestCluster(3, "rebalance-deadlines", countingGetter(&calls),
+		WithTTL(time.Hour), WithSoftTTL(50*time.Millisecond), WithStaleOnError(time.Hour))
+	defer stop()
+	for _, pool := range pools {
+		pool.SetHandoffRate(0)
+	}
+	ctx := context.Background()
+	for i := 0; i < 50; i++ {
+		if _, err := groups[0].Get(ctx, fmt.Sprint(i), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expires := make(map[string]time.Time)
+	for _, e := range groups[2].mainCache.entries() {
+		expires[e.key] = e.value.expires
+	}
+	if len(expires) == 0 {
+		t.Fatal("the leaving node caches nothing")
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	if err := pools[2].Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, g := range groups[:2] {
+		for _, e := range g.mainCache.entries() {
+			want, ok := expires[e.key]
+			if !ok {
+				continue
+			}
+			if d := e.value.expires.Sub(want); d < -time.Second || d > time.Second {
+				t.Errorf("%s expires %v after it did on the previous owner", e.key, d)
+			}
+			if e.ttl > 2*time.Hour {
+				t.Errorf("%s is cached for %v, more than its TTL and grace", e.key, e.ttl)
+			}
+			if !e.value.pastSoftTTL(now) {
+				t.Errorf("%s went stale on the previous owner, but is fresh again", e.key)
+			}
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	var calls int32
+	groups, pools, stop := newTestCluster(3, "rebalance-drain", countingGetter(&calls))
+	defer stop()
+	for _, pool := range pools {
+		pool.SetHandoffRate(0)
+	}
+	ctx := context.Background()
+	const n = 200
+	for i := 0; i < n; i++ {
+		if _, err := groups[0].Get(ctx, fmt.Sprint(i), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leaving := groups[2].CacheStats(MainCache).Items
+	if leaving == 0 {
+		t.Fatal("the leaving node caches nothing")
+	}
+
+	if err := pools[2].Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if items := groups[2].CacheStats(MainCache).Items; items != 0 {
+		t.Errorf("%d entries left after Drain", items)
+	}
+	if got := groups[2].Stats.KeysHandedOff.Get(); got != leaving {
+		t.Errorf("KeysHandedOff = %d, want %d", got, leaving)
+	}
+	// Requests still reaching the drained node are forwarded.
+	if _, ok := pools[2].owner("0"); !ok {
+		t.Error("the drained node still owns keys")
+	}
+	pools[2].Set(pools[2].Peers()...)
+	if _, ok := pools[2].owner("0"); !ok {
+		t.Error("Set put the drained node back on its ring")
+	}
+
+	rest := pools[2].Peers()
+	for _, pool := range pools[:2] {
+		pool.Set(rest...)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := groups[0].Get(ctx, fmt.Sprint(i), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := atomic.LoadInt32(&calls); calls != n {
+		t.Errorf("getter called %d times, want %d: drained keys were loaded again", calls, n)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	th := &throttle{rate: 10000}
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := th.wait(ctx, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 1000 bytes at 10000 bytes per second.
+	if d := time.Since(start); d < 90*time.Millisecond || d > time.Second {
+		t.Errorf("1000 bytes took %v, want about 100ms", d)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := (&throttle{rate: 1}).wait(ctx, 100); err != context.Canceled {
+		t.Errorf("wait after cancel = %v, want %v", err, context.Canceled)
+	}
+}
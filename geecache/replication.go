@@ -0,0 +1,419 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pb "geecache/geecachepb"
+	"geecache/singleflight"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// repairTimeout bounds the background writes of read repair.
+const repairTimeout = 5 * time.Second
+
+// Replication configures WithReplication.
+type Replication struct {
+	// N is the number of peers holding every key: its owner and the next
+	// N-1 distinct peers on the ring.
+	N int
+	// R is the number of replicas a Get reads. The newest value read
+	// wins, and replicas found holding an older one are repaired. It
+	// defaults to a majority of N.
+	R int
+	// W is the number of replicas that must store a value for Set and Add
+	// to succeed. It defaults to a majority of N.
+	W int
+}
+
+// WithReplication keeps every key on N peers rather than only on its
+// owner, so losing a peer loses none of the keys. The group's PeerPicker
+// must implement ReplicaPicker, as HTTPPool and GRPCPool do.
+//
+// With R + W > N, a Get sees the latest successful write. A Get with
+// R > 1 reads the other replicas even when this peer has the key cached;
+// R = 1 serves cached values as they are.
+func WithReplication(r Replication) GroupOption {
+	if r.N < 1 {
+		r.N = 1
+	}
+	majority := r.N/2 + 1
+	if r.R < 1 {
+		r.R = majority
+	}
+	if r.W < 1 {
+		r.W = majority
+	}
+	if r.R > r.N {
+		r.R = r.N
+	}
+	if r.W > r.N {
+		r.W = r.N
+	}
+	return func(g *Group) {
+		g.replication = &r
+	}
+}
+
+// replicas returns the peers holding key's replicas, nil standing for
+// this peer. It returns nil if the group is not replicated.
+func (g *Group) replicas(key string) []PeerGetter {
+	if g.replication == nil {
+		return nil
+	}
+	rp, ok := g.peers.(ReplicaPicker)
+	if !ok {
+		return nil
+	}
+	return rp.PickReplicas(key, g.replication.N)
+}
+
+// replicaRead is the outcome of reading one replica.
+type replicaRead struct {
+	i      int // index of the replica
+	value  ByteView
+	source Source
+	err    error
+}
+
+// missing reports whether the replica read does not hold the key: a
+// replica other than the owner answering not found without a version.
+// Only the owner's answer tells that the key does not exist.
+func (r replicaRead) missing() bool {
+	return r.i != 0 && r.value.notFound && r.value.version == 0
+}
+
+// getReplicated reads key from R of its replicas, reading further
+// replicas in place of failing ones, and returns the newest value.
+// Replicas found holding an older value are repaired in the background.
+// Concurrent reads of a key are deduplicated like loads.
+func (g *Group) getReplicated(ctx context.Context, key string, replicas []PeerGetter) (ByteView, Source, error) {
+	for {
+		resulti, err := g.replicaLoader.DoContext(ctx, key, func() (interface{}, error) {
+			return g.readQuorum(ctx, key, replicas)
+		})
+		if err == nil {
+			result := resulti.(loadResult)
+			return result.value, result.source, nil
+		}
+		if err == singleflight.ErrLeaderGone {
+			if ctx.Err() == nil {
+				// The caller that ran the read went away, but this one did not.
+				continue
+			}
+			err = ctx.Err()
+		}
+		return ByteView{}, FromCache, err
+	}
+}
+
+func (g *Group) readQuorum(ctx context.Context, key string, replicas []PeerGetter) (interface{}, error) {
+	need := g.replication.R
+	if need > len(replicas) {
+		need = len(replicas)
+	}
+	reads := make(chan replicaRead, len(replicas))
+	next := 0
+	readNext := func() {
+		i := next
+		next++
+		go func() {
+			value, source, err := g.readReplica(ctx, replicas[i], key, i == 0)
+			reads <- replicaRead{i, value, source, err}
+		}()
+	}
+	for next < need {
+		readNext()
+	}
+	var (
+		got     []replicaRead
+		lastErr error
+	)
+	for pending := need; pending > 0 && len(got) < need; pending-- {
+		r := <-reads
+		if r.err == nil {
+			got = append(got, r)
+			continue
+		}
+		lastErr = r.err
+		if next < len(replicas) {
+			readNext()
+			pending++
+		}
+	}
+	if len(got) < need {
+		g.Stats.QuorumFailures.Add(1)
+		return nil, fmt.Errorf("read %d of %d replicas, %d required: %v", len(got), len(replicas), need, lastErr)
+	}
+
+	newest := got[0]
+	for _, r := range got[1:] {
+		if r.value.version > newest.value.version ||
+			r.value.version == newest.value.version && newest.missing() && !r.missing() {
+			newest = r
+		}
+	}
+	if newest.missing() {
+		// None of the replicas read holds the key, and the owner was not
+		// among them: it is loaded through the owner.
+		value, source, err := g.load(ctx, key, false)
+		if err != nil {
+			return nil, err
+		}
+		newest = replicaRead{i: 0, value: value, source: source}
+	}
+	for _, r := range got {
+		if r.value.version < newest.value.version || r.missing() && !newest.value.notFound {
+			g.repair(replicas[r.i], key, newest.value)
+		}
+	}
+	if newest.value.notFound {
+		return nil, ErrNotFound
+	}
+	if !holdsReplica(replicas) {
+		g.admitHot(key, newest.value)
+	}
+	return loadResult{newest.value, newest.source}, nil
+}
+
+// readReplica reads key from one replica, nil being this peer. Only the
+// owner loads a key it does not hold, the other replicas answer from
+// their caches. A replica answering that key does not exist is read a
+// negative entry, which any stored value is newer than, unless it is the
+// tombstone of a delete.
+func (g *Group) readReplica(ctx context.Context, peer PeerGetter, key string, owner bool) (ByteView, Source, error) {
+	if peer == nil && !owner {
+		value, err := g.getReplica(key)
+		if errors.Is(err, ErrNotFound) {
+			return ByteView{notFound: true, version: value.version}, FromCache, nil
+		}
+		return value, FromCache, err
+	}
+	if peer == nil {
+		if v, ok := g.mainCache.get(key); ok && !v.expired(time.Now()) {
+			g.Stats.CacheHits.Add(1)
+			return v, FromCache, nil
+		}
+		value, source, err := g.load(ctx, key, true)
+		if errors.Is(err, ErrNotFound) {
+			return ByteView{notFound: true}, FromGetter, nil
+		}
+		return value, source, err
+	}
+	value, err := g.getFromPeer(ctx, peer, key, !owner)
+	if errors.Is(err, ErrNotFound) {
+		g.Stats.PeerLoads.Add(1)
+		return value, FromPeer, nil
+	}
+	if err != nil {
+		g.Stats.PeerErrors.Add(1)
+		return ByteView{}, FromPeer, err
+	}
+	g.Stats.PeerLoads.Add(1)
+	return value, FromPeer, nil
+}
+
+// repair sends the newest value of key to a replica holding an older
+// one, in the background. A tombstone is sent as a delete.
+func (g *Group) repair(peer PeerGetter, key string, value ByteView) {
+	g.Stats.ReadRepairs.Add(1)
+	if peer == nil {
+		if value.notFound {
+			g.deleteReplica(key, value.version)
+		} else {
+			g.takeReplica(key, value, 0)
+		}
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), repairTimeout)
+		defer cancel()
+		var err error
+		if value.notFound {
+			_, err = peer.Delete(ctx, &pb.Request{Group: g.name, Key: key, Replica: true, Version: value.version})
+		} else {
+			err = g.setOnPeer(ctx, peer, key, value, 0, true)
+		}
+		if err != nil {
+			log.Println("[GeeCache] Failed to repair replica", err)
+		}
+	}()
+}
+
+// addReplicated stores value on key's replicas under a new version, so it
+// replaces the values they hold, and succeeds once W of them did. The
+// owner writes the value to the store as well, and an error is returned
+// if that failed.
+func (g *Group) addReplicated(ctx context.Context, key string, value ByteView, ttl time.Duration, replicas []PeerGetter) error {
+	value.version = newVersion()
+	type result struct {
+		owner bool
+		err   error
+	}
+	results := make(chan result, len(replicas))
+	for i, peer := range replicas {
+		go func(owner bool, peer PeerGetter) {
+			res := result{owner: owner}
+			switch {
+			case peer == nil && owner:
+				res.err = g.Add(ctx, key, value, ttl, true)
+			case peer == nil:
+				g.takeReplica(key, value, ttl)
+			default:
+				res.err = g.setOnPeer(ctx, peer, key, value, ttl, !owner)
+			}
+			results <- res
+		}(i == 0, peer)
+	}
+	need := g.replication.W
+	if need > len(replicas) {
+		need = len(replicas)
+	}
+	stored := 0
+	var ownerErr, lastErr error
+	for range replicas {
+		res := <-results
+		if res.err != nil {
+			log.Println("[GeeCache] Failed to update replica", res.err)
+			lastErr = res.err
+			if res.owner {
+				ownerErr = res.err
+			}
+			continue
+		}
+		stored++
+	}
+	if ownerErr != nil {
+		return ownerErr
+	}
+	if stored < need {
+		g.Stats.QuorumFailures.Add(1)
+		return fmt.Errorf("stored on %d of %d replicas, %d required: %v", stored, len(replicas), need, lastErr)
+	}
+	return nil
+}
+
+// deleteReplicated deletes key from its replicas under a new version,
+// leaving tombstones that read repair spreads to the replicas that missed
+// the delete, and succeeds once W of them did. The owner deletes the key
+// from the store as well, and an error is returned if that failed.
+func (g *Group) deleteReplicated(ctx context.Context, key string, replicas []PeerGetter) (int, error) {
+	version := newVersion()
+	type result struct {
+		deleted bool
+		owner   bool
+		err     error
+	}
+	results := make(chan result, len(replicas))
+	for i, peer := range replicas {
+		go func(owner bool, peer PeerGetter) {
+			res := result{owner: owner}
+			switch {
+			case peer == nil && owner:
+				var n int
+				n, res.err = g.deleteOwned(ctx, key, version)
+				res.deleted = n > 0
+			case peer == nil:
+				res.deleted = g.deleteReplica(key, version) > 0
+			default:
+				res.deleted, res.err = peer.Delete(ctx, &pb.Request{Group: g.name, Key: key, Replica: !owner, Version: version})
+			}
+			results <- res
+		}(i == 0, peer)
+	}
+	need := g.replication.W
+	if need > len(replicas) {
+		need = len(replicas)
+	}
+	n, done := 0, 0
+	var ownerErr, lastErr error
+	for range replicas {
+		res := <-results
+		if res.err != nil {
+			log.Println("[GeeCache] Failed to delete a replica", res.err)
+			lastErr = res.err
+			if res.owner {
+				ownerErr = res.err
+			}
+			continue
+		}
+		done++
+		if res.deleted {
+			n = 1
+		}
+	}
+	if ownerErr != nil {
+		return 0, ownerErr
+	}
+	if done < need {
+		g.Stats.QuorumFailures.Add(1)
+		return 0, fmt.Errorf("deleted on %d of %d replicas, %d required: %v", done, len(replicas), need, lastErr)
+	}
+	return n, nil
+}
+
+// deleteOwned deletes key on its owner for a delete of the given version:
+// from the store, then from the cache like deleteReplica.
+func (g *Group) deleteOwned(ctx context.Context, key string, version int64) (int, error) {
+	if err := g.storeDelete(ctx, key); err != nil {
+		return 0, err
+	}
+	return g.deleteReplica(key, version), nil
+}
+
+// getReplica answers a replica read of key from the main cache, without
+// loading it: ErrNotFound stands for a key the cache does not hold, with
+// the version of its tombstone if there is one.
+func (g *Group) getReplica(key string) (ByteView, error) {
+	if v, ok := g.mainCache.get(key); ok && !v.expired(time.Now()) {
+		v, _, err := g.cacheHit(v)
+		return v, err
+	}
+	return ByteView{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+}
+
+// takeReplica caches a replica's value unless a newer one is cached.
+func (g *Group) takeReplica(key string, value ByteView, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = g.ttl
+	}
+	value, ttl = g.stamp(value, ttl)
+	g.mainCache.addIfNewer(key, value, ttl)
+}
+
+// deleteReplica deletes key from the cache of a replica that is not the
+// key's owner. A delete with a version leaves a tombstone, a negative
+// entry of that version kept as long as values, unless a newer value is
+// cached.
+func (g *Group) deleteReplica(key string, version int64) int {
+	var deleted bool
+	if version == 0 {
+		deleted = g.mainCache.remove(key)
+	} else {
+		deleted = g.mainCache.removeIfOlder(key, ByteView{notFound: true, version: version}, g.ttl)
+	}
+	if deleted {
+		return 1
+	}
+	return 0
+}
+
+// lastVersion is the last version handed out by newVersion.
+var lastVersion int64
+
+// newVersion returns a version for a write: the time in nanoseconds,
+// made to increase on this peer.
+func newVersion() int64 {
+	for {
+		last := atomic.LoadInt64(&lastVersion)
+		v := time.Now().UnixNano()
+		if v <= last {
+			v = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastVersion, last, v) {
+			return v
+		}
+	}
+}
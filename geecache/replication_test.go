@@ -0,0 +1,261 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// crashable makes node i of a cluster fail every request while down[i]
+// is 1, as if it crashed. It is a wrap for newWrappedCluster.
+func crashable(down []int32) func(int, http.Handler) http.Handler {
+	return func(i int, h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&down[i]) == 1 {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// replicaNodes returns the indexes of the nodes holding key's n
+// replicas, and of a node that holds none.
+func replicaNodes(pools []*HTTPPool, key string, n int) (replicas []int, other int) {
+	other = -1
+	for i, pool := range pools {
+		if holdsReplica(pool.PickReplicas(key, n)) {
+			replicas = append(replicas, i)
+		} else {
+			other = i
+		}
+	}
+	return replicas, other
+}
+
+// holds reports whether node i is among the nodes caching a value of key.
+func holds(groups []*Group, key string, i int) bool {
+	for _, j := range cachedOn(groups, key) {
+		if j == i {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReplicatedSet(t *testing.T) {
+	store := newFakeStore()
+	groups, pools, stop := newTestCluster(4, "replicated-set", store, WithReplication(Replication{N: 3}))
+	defer stop()
+	ctx := context.Background()
+
+	replicas, other := replicaNodes(pools, "k", 3)
+	if len(replicas) != 3 || other < 0 {
+		t.Fatalf("k has replicas on %v", replicas)
+	}
+	if err := groups[other].Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if on := cachedOn(groups, "k"); fmt.Sprint(on) != fmt.Sprint(replicas) {
+		t.Errorf("k is cached on %v, want its replicas %v", on, replicas)
+	}
+	// Only the owner writes to the store.
+	if n := store.writeCount(); n != 1 {
+		t.Errorf("store got %d writes, want 1", n)
+	}
+
+	if n, err := groups[other].Delete(ctx, "k", false); err != nil || n != 1 {
+		t.Errorf("Delete = %d, %v; want 1", n, err)
+	}
+	if on := cachedOn(groups, "k"); len(on) != 0 {
+		t.Errorf("k is still cached on %v after Delete", on)
+	}
+	if _, ok := store.get("k"); ok {
+		t.Error("store still has k after Delete")
+	}
+
+	// A write the store rejected is not acknowledged, whatever the
+	// other replicas did.
+	store.mu.Lock()
+	store.fail = 1
+	store.mu.Unlock()
+	if err := groups[other].Set(ctx, "k", []byte("v2")); err == nil {
+		t.Error("Set succeeded though the owner failed to write to the store")
+	}
+}
+
+func TestReplicatedColdLoad(t *testing.T) {
+	var calls int32
+	groups, pools, stop := newTestCluster(4, "replicated-cold", countingGetter(&calls), WithReplication(Replication{N: 3, R: 3}))
+	defer stop()
+	ctx := context.Background()
+
+	replicas, other := replicaNodes(pools, "k", 3)
+	if view, err := groups[other].Get(ctx, "k", false); err != nil || view.String() != "db k" {
+		t.Fatalf("Get = %q, %v; want db k", view.String(), err)
+	}
+	// Only the owner loads k, the other replicas are filled from it.
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("getter called %d times, want 1", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fmt.Sprint(cachedOn(groups, "k")) != fmt.Sprint(replicas) {
+		if time.Now().After(deadline) {
+			t.Fatalf("k is cached on %v, want its replicas %v", cachedOn(groups, "k"), replicas)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A replica other than the owner does not load either.
+	replicas, _ = replicaNodes(pools, "k2", 3)
+	replica := replicas[0]
+	if replica == ownerIndex(pools, "k2") {
+		replica = replicas[1]
+	}
+	if _, err := groups[replica].Get(ctx, "k2", false); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("getter called %d times after loading k2, want 2", n)
+	}
+}
+
+func TestReplicaFailover(t *testing.T) {
+	down := make([]int32, 4)
+	groups, pools, stop := newWrappedCluster(4, "replica-failover", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s not found", key)
+		}), crashable(down), WithReplication(Replication{N: 3, R: 2, W: 2}))
+	defer stop()
+	ctx := context.Background()
+
+	replicas, other := replicaNodes(pools, "k", 3)
+	owner := ownerIndex(pools, "k")
+	if err := groups[other].Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing the owner loses nothing, but the owner must take every write.
+	atomic.StoreInt32(&down[owner], 1)
+	if view, err := groups[other].Get(ctx, "k", false); err != nil || view.String() != "v" {
+		t.Fatalf("Get without the owner = %q, %v; want v", view.String(), err)
+	}
+	if err := groups[other].Set(ctx, "k", []byte("v2")); err == nil {
+		t.Error("Set succeeded without the owner")
+	}
+	atomic.StoreInt32(&down[owner], 0)
+
+	// Losing another replica leaves a quorum.
+	lost := replicas[0]
+	if lost == owner {
+		lost = replicas[1]
+	}
+	atomic.StoreInt32(&down[lost], 1)
+	if err := groups[other].Set(ctx, "k", []byte("v3")); err != nil {
+		t.Fatalf("Set with two replicas of three: %v", err)
+	}
+
+	// Losing two of three does not make a quorum.
+	atomic.StoreInt32(&down[owner], 1)
+	if _, err := groups[other].Get(ctx, "k", false); err == nil {
+		t.Error("Get succeeded with one replica of three")
+	}
+	if got := groups[other].Stats.QuorumFailures.Get(); got != 1 {
+		t.Errorf("QuorumFailures = %d, want 1", got)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	down := make([]int32, 4)
+	groups, pools, stop := newWrappedCluster(4, "read-repair", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}), crashable(down), WithReplication(Replication{N: 3, R: 3, W: 2}))
+	defer stop()
+	ctx := context.Background()
+
+	replicas, other := replicaNodes(pools, "k", 3)
+	// The owner must not miss the write.
+	stale := replicas[0]
+	if stale == ownerIndex(pools, "k") {
+		stale = replicas[1]
+	}
+	atomic.StoreInt32(&down[stale], 1)
+	if err := groups[other].Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&down[stale], 0)
+
+	// The stale replica finds no k, the write wins over its negative entry.
+	if view, err := groups[other].Get(ctx, "k", false); err != nil || view.String() != "v" {
+		t.Fatalf("Get = %q, %v; want v", view.String(), err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !holds(groups, "k", stale) {
+		if time.Now().After(deadline) {
+			t.Fatal("stale replica was not repaired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := groups[other].Stats.ReadRepairs.Get(); got != 1 {
+		t.Errorf("ReadRepairs = %d, want 1", got)
+	}
+}
+
+func TestReplicatedDeleteTombstone(t *testing.T) {
+	down := make([]int32, 4)
+	groups, pools, stop := newWrappedCluster(4, "replicated-delete", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}), crashable(down), WithReplication(Replication{N: 3, R: 3, W: 2}))
+	defer stop()
+	ctx := context.Background()
+
+	replicas, other := replicaNodes(pools, "k", 3)
+	if err := groups[other].Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	// A replica missing the delete keeps v. The owner must not miss it.
+	stale := replicas[0]
+	if stale == ownerIndex(pools, "k") {
+		stale = replicas[1]
+	}
+	atomic.StoreInt32(&down[stale], 1)
+	if n, err := groups[other].Delete(ctx, "k", false); err != nil || n != 1 {
+		t.Fatalf("Delete with two replicas of three = %d, %v; want 1", n, err)
+	}
+	atomic.StoreInt32(&down[stale], 0)
+
+	// The tombstones are newer than v, which is not brought back.
+	if view, err := groups[other].Get(ctx, "k", false); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete = %q, %v; want ErrNotFound", view.String(), err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for holds(groups, "k", stale) {
+		if time.Now().After(deadline) {
+			t.Fatal("stale replica still caches k")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The owner alone does not make a quorum.
+	if err := groups[other].Set(ctx, "k", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range replicas {
+		if i != ownerIndex(pools, "k") {
+			atomic.StoreInt32(&down[i], 1)
+		}
+	}
+	if n, err := groups[other].Delete(ctx, "k", false); err == nil {
+		t.Errorf("Delete with one replica of three = %d, want an error", n)
+	}
+	if got := groups[other].Stats.QuorumFailures.Get(); got != 1 {
+		t.Errorf("QuorumFailures = %d, want 1", got)
+	}
+}
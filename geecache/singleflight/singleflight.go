@@ -1,12 +1,23 @@
 package singleflight
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrLeaderGone is returned to the duplicate callers of a call that
+// failed once the context of the caller running it was done. The failure
+// is the leader's, so they may try again.
+var ErrLeaderGone = errors.New("singleflight: the caller running the call went away")
 
 // call is an in-flight or completed Do call
 type call struct {
-	wg  sync.WaitGroup
-	val interface{}
-	err error
+	done chan struct{} // closed once val and err are set
+	val  interface{}
+	err  error
+	// leaderGone is set if the call failed after its caller's ctx was done
+	leaderGone bool
 }
 
 // Group represents a class of work and forms a namespace in which
@@ -21,26 +32,69 @@ type Group struct {
 // time. If a duplicate comes in, the duplicate caller waits for the
 // original to complete and receives the same results.
 func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return g.DoContext(context.Background(), key, fn)
+}
+
+// DoContext is like Do, but a duplicate caller stops waiting and returns
+// ctx.Err() once ctx is done. The original call is left running for the
+// other callers; fn should watch its own context to stop early. If it
+// fails once ctx is done, the duplicate callers get ErrLeaderGone.
+func (g *Group) DoContext(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
 	g.mu.Lock()
 	if g.m == nil {
 		g.m = make(map[string]*call)
 	}
 	if c, ok := g.m[key]; ok {
 		g.mu.Unlock()
-		c.wg.Wait()
-		return c.val, c.err
+		select {
+		case <-c.done:
+			if c.leaderGone {
+				return nil, ErrLeaderGone
+			}
+			return c.val, c.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
-	c := new(call)
-	c.wg.Add(1)
+	c := &call{done: make(chan struct{})}
 	g.m[key] = c
 	g.mu.Unlock()
 
-	c.val, c.err = fn()
-	c.wg.Done()
+	val, err := fn()
+	g.finish(ctx, key, c, val, err)
+	return val, err
+}
 
+// Start puts a call of key in flight, unless one is already, and returns
+// the function completing it with its results. Until then Do and
+// DoContext callers of key wait for it as for any call. It lets a caller
+// run the calls of several keys together, e.g. in a single request. ctx
+// is the caller's, as for DoContext. ok is false if a call of key was in
+// flight already.
+func (g *Group) Start(ctx context.Context, key string) (finish func(val interface{}, err error), ok bool) {
 	g.mu.Lock()
-	delete(g.m, key)
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	if _, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		return nil, false
+	}
+	c := &call{done: make(chan struct{})}
+	g.m[key] = c
 	g.mu.Unlock()
+	return func(val interface{}, err error) {
+		g.finish(ctx, key, c, val, err)
+	}, true
+}
 
-	return c.val, c.err
+// finish completes the call c of key with its results.
+func (g *Group) finish(ctx context.Context, key string, c *call, val interface{}, err error) {
+	c.val, c.err = val, err
+	c.leaderGone = err != nil && ctx.Err() != nil
+	close(c.done)
+
+	g.mu.Lock()
+	delete(g.m, key)
+	g.mu.Unlock()
 }
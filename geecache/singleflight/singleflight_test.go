@@ -1,6 +1,8 @@
 package singleflight
 
 import (
+	"context"
+	"sync"
 	"testing"
 )
 
@@ -14,3 +16,101 @@ func TestDo(t *testing.T) {
 		t.Errorf("Do v = %v, error = %v", v, err)
 	}
 }
+
+func TestDoContextWaiterCancel(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go g.Do("key", func() (interface{}, error) {
+		close(started)
+		<-release
+		return "bar", nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := g.DoContext(ctx, "key", func() (interface{}, error) {
+		t.Error("duplicate call must not run fn")
+		return nil, nil
+	}); err != context.Canceled {
+		t.Errorf("DoContext error = %v, expect %v", err, context.Canceled)
+	}
+	close(release)
+}
+
+func TestDoContextLeaderGone(t *testing.T) {
+	var g Group
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go g.DoContext(ctx, "key", func() (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	<-started
+
+	errs := make(chan error)
+	go func() {
+		_, err := g.DoContext(context.Background(), "key", func() (interface{}, error) {
+			return "bar", nil
+		})
+		errs <- err
+	}()
+	cancel()
+	// The duplicate call either waited for the leader or ran after it.
+	if err := <-errs; err != ErrLeaderGone && err != nil {
+		t.Errorf("DoContext error = %v, expect %v or nil", err, ErrLeaderGone)
+	}
+
+	// A leader failing on its own, with its ctx live, is not gone.
+	deadline := context.DeadlineExceeded
+	if _, err := g.DoContext(context.Background(), "key", func() (interface{}, error) {
+		return nil, deadline
+	}); err != deadline {
+		t.Errorf("DoContext error = %v, expect %v", err, deadline)
+	}
+}
+
+func TestStart(t *testing.T) {
+	var g Group
+	finish, ok := g.Start(context.Background(), "key")
+	if !ok {
+		t.Fatal("Start of an idle key is not ok")
+	}
+	if _, ok := g.Start(context.Background(), "key"); ok {
+		t.Error("Start of a key in flight is ok")
+	}
+
+	waiting := make(chan struct{})
+	vals := make(chan interface{})
+	go func() {
+		ctx := &waitingContext{Context: context.Background(), waiting: waiting}
+		v, _ := g.DoContext(ctx, "key", func() (interface{}, error) {
+			t.Error("duplicate call must not run fn")
+			return nil, nil
+		})
+		vals <- v
+	}()
+	<-waiting
+	finish("bar", nil)
+	if v := <-vals; v != "bar" {
+		t.Errorf("DoContext v = %v, expect bar", v)
+	}
+	if _, ok := g.Start(context.Background(), "key"); !ok {
+		t.Error("Start of a finished key is not ok")
+	}
+}
+
+// waitingContext closes waiting once Done is called, which DoContext only
+// does for a duplicate call about to wait.
+type waitingContext struct {
+	context.Context
+	waiting chan struct{}
+	once    sync.Once
+}
+
+func (c *waitingContext) Done() <-chan struct{} {
+	c.once.Do(func() { close(c.waiting) })
+	return c.Context.Done()
+}
@@ -0,0 +1,85 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// refreshTimeout bounds the background reload of a stale value.
+const refreshTimeout = 10 * time.Second
+
+// WithSoftTTL makes the values the group caches stale after ttl. A stale
+// value is still answered at once, and reloaded with the Getter in the
+// background, once per key however many Gets see it. The TTL set with
+// WithTTL, or given to Add, is then the hard TTL: past it, Get waits for
+// the reload.
+func WithSoftTTL(ttl time.Duration) GroupOption {
+	return func(g *Group) {
+		g.softTTL = ttl
+	}
+}
+
+// WithStaleOnError keeps the values the group caches for grace past their
+// hard TTL. Until then a Get whose reload fails answers the old value,
+// marked stale, rather than the error. A key the Getter reports missing
+// is not served stale.
+func WithStaleOnError(grace time.Duration) GroupOption {
+	return func(g *Group) {
+		g.staleOnError = grace
+	}
+}
+
+// stamp sets the soft and hard deadlines of a value cached for ttl, 0
+// meaning for ever, and returns how long the cache has to keep it.
+func (g *Group) stamp(value ByteView, ttl time.Duration) (ByteView, time.Duration) {
+	now := time.Now()
+	if ttl > 0 {
+		value.expires = now.Add(ttl)
+	}
+	if g.softTTL > 0 && (ttl <= 0 || g.softTTL < ttl) {
+		value.fresh = now.Add(g.softTTL)
+	}
+	if ttl > 0 && g.staleOnError > 0 {
+		ttl += g.staleOnError
+	}
+	return value, ttl
+}
+
+// refresh reloads key with the Getter in the background, unless a
+// refresh of key is running already. It reports whether it started one.
+func (g *Group) refresh(key string) bool {
+	if _, running := g.refreshing.LoadOrStore(key, true); running {
+		return false
+	}
+	g.Stats.Refreshes.Add(1)
+	go func() {
+		defer g.refreshing.Delete(key)
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+		if _, _, err := g.load(ctx, key, true); err != nil {
+			log.Println("[GeeCache] Failed to refresh", key, err)
+		}
+	}()
+	return true
+}
+
+// loadOrStale loads key like load. If that fails, and old is a value kept
+// past its hard TTL by WithStaleOnError, old is answered instead.
+func (g *Group) loadOrStale(ctx context.Context, key string, local bool, old ByteView, ok bool) (ByteView, Source, error) {
+	value, source, err := g.load(ctx, key, local)
+	if err == nil || !ok || errors.Is(err, ErrNotFound) || ctx.Err() != nil {
+		return value, source, err
+	}
+	return g.serveStale(key, old, err), FromCache, nil
+}
+
+// serveStale returns old, marked stale, in place of the error err of a
+// failed load of key.
+func (g *Group) serveStale(key string, old ByteView, err error) ByteView {
+	log.Println("[GeeCache] Serving stale", key, err)
+	g.Stats.StaleOnError.Add(1)
+	old.stale = true
+	return old
+}
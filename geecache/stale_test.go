@@ -0,0 +1,112 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	g := NewGroup("stale-while-revalidate", 2<<10, GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			n := atomic.AddInt32(&calls, 1)
+			if n > 1 {
+				<-release
+			}
+			return []byte(fmt.Sprint("v", n)), nil
+		}), WithSoftTTL(50*time.Millisecond), WithTTL(time.Minute))
+	ctx := context.Background()
+
+	if view, err := g.Get(ctx, "k", false); err != nil || view.String() != "v1" || view.Stale() {
+		t.Fatalf("first Get = %q, stale %t, err %v", view.String(), view.Stale(), err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// The refresh is blocked, yet every Get answers at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if view, err := g.Get(ctx, "k", false); err != nil || view.String() != "v1" || !view.Stale() {
+				t.Errorf("Get past the soft TTL = %q, stale %t, err %v", view.String(), view.Stale(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		view, err := g.Get(ctx, "k", false)
+		if err == nil && view.String() == "v2" && !view.Stale() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Get after the refresh = %q, stale %t, err %v", view.String(), view.Stale(), err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("getter called %d times, want 2", n)
+	}
+	if n := g.Stats.Refreshes.Get(); n != 1 {
+		t.Errorf("Refreshes = %d, want 1", n)
+	}
+}
+
+func TestStaleOnError(t *testing.T) {
+	// state is 0 while the getter works, then 1 for a transient failure
+	// and 2 for a missing key.
+	var state int32
+	groups, pools, stop := newTestCluster(1, "stale-on-error", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			switch atomic.LoadInt32(&state) {
+			case 1:
+				return nil, errors.New("database unavailable")
+			case 2:
+				return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+			}
+			return []byte("v"), nil
+		}), WithTTL(50*time.Millisecond), WithStaleOnError(time.Minute))
+	defer stop()
+	g := groups[0]
+	ctx := context.Background()
+
+	if _, err := g.Get(ctx, "k", false); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&state, 1)
+	time.Sleep(60 * time.Millisecond)
+
+	if view, err := g.Get(ctx, "k", false); err != nil || view.String() != "v" || !view.Stale() {
+		t.Fatalf("Get with a failing getter = %q, stale %t, err %v", view.String(), view.Stale(), err)
+	}
+	if n := g.Stats.StaleOnError.Get(); n != 1 {
+		t.Errorf("StaleOnError = %d, want 1", n)
+	}
+	if s := g.CacheStats(MainCache); s.Stale == 0 || s.Hits != 0 {
+		t.Errorf("cache stats: %d stale, %d hits; want the expired entry counted stale, not a hit", s.Stale, s.Hits)
+	}
+	res, err := http.Get(pools[0].self + "/stale-on-error/k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get(staleHeader) != "true" {
+		t.Errorf("GET: status %v, %s %q", res.Status, staleHeader, res.Header.Get(staleHeader))
+	}
+
+	// A missing key is not served stale.
+	atomic.StoreInt32(&state, 2)
+	if _, err := g.Get(ctx, "k", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a removed key: err %v, want ErrNotFound", err)
+	}
+}
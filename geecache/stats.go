@@ -0,0 +1,98 @@
+package geecache
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// An AtomicInt is an int64 to be accessed atomically.
+type AtomicInt int64
+
+// Add atomically adds n to i.
+func (i *AtomicInt) Add(n int64) {
+	atomic.AddInt64((*int64)(i), n)
+}
+
+// Get atomically gets the value of i.
+func (i *AtomicInt) Get() int64 {
+	return atomic.LoadInt64((*int64)(i))
+}
+
+func (i *AtomicInt) String() string {
+	return strconv.FormatInt(i.Get(), 10)
+}
+
+// MarshalJSON encodes i as a JSON number.
+func (i *AtomicInt) MarshalJSON() ([]byte, error) {
+	return []byte(i.String()), nil
+}
+
+// Stats are per-group statistics.
+type Stats struct {
+	Gets           AtomicInt `json:"gets"`            // any Get request, including from peers
+	CacheHits      AtomicInt `json:"cache_hits"`      // the value was in the local cache
+	PeerLoads      AtomicInt `json:"peer_loads"`      // loaded from the key's owner
+	PeerErrors     AtomicInt `json:"peer_errors"`     // the owner could not be asked
+	PeerBatches    AtomicInt `json:"peer_batches"`    // batched requests sent to owners by GetMany, SetMany and DeleteMany
+	Loads          AtomicInt `json:"loads"`           // gets - cacheHits
+	LoadsDeduped   AtomicInt `json:"loads_deduped"`   // loads left after singleflight
+	LocalLoads     AtomicInt `json:"local_loads"`     // good loads with the Getter
+	LocalLoadErrs  AtomicInt `json:"local_load_errs"` // bad loads with the Getter, other than not found
+	LocalNotFound  AtomicInt `json:"local_not_found"` // loads the Getter reported missing
+	NegativeHits   AtomicInt `json:"negative_hits"`   // gets answered ErrNotFound from the cache
+	StaleHits      AtomicInt `json:"stale_hits"`      // cache hits past the soft TTL
+	Refreshes      AtomicInt `json:"refreshes"`       // background reloads, of stale values or early ones
+	EarlyRefreshes AtomicInt `json:"early_refreshes"` // background reloads of values nearing their deadline
+	StaleOnError   AtomicInt `json:"stale_on_error"`  // gets answered an expired value as the reload failed
+	ServerRequests AtomicInt `json:"server_requests"` // gets that came over the network from peers
+
+	StoreWrites     AtomicInt `json:"store_writes"`     // sets and deletes written to the Setter or Deleter
+	StoreErrs       AtomicInt `json:"store_errs"`       // failed writes to the store, including retried ones
+	WritesCoalesced AtomicInt `json:"writes_coalesced"` // write-behind writes replacing a pending one
+	WritesDropped   AtomicInt `json:"writes_dropped"`   // write-behind writes given up after retries
+
+	KeysHandedOff AtomicInt `json:"keys_handed_off"` // entries sent to their new owner after the ring changed
+	HandoffErrs   AtomicInt `json:"handoff_errs"`    // entries the new owner could not take
+	KeysTakenOver AtomicInt `json:"keys_taken_over"` // entries cached from their previous owner
+
+	ReadRepairs    AtomicInt `json:"read_repairs"`    // replicas sent a newer value found by a read
+	QuorumFailures AtomicInt `json:"quorum_failures"` // reads and writes reaching fewer replicas than R or W
+}
+
+// CacheType names one of the caches of a Group.
+type CacheType int
+
+const (
+	// MainCache is the cache of the keys this peer owns.
+	MainCache CacheType = iota + 1
+	// HotCache is the cache of popular keys owned by other peers, see
+	// WithHotCache.
+	HotCache
+)
+
+// CacheStats are the statistics of one of a Group's caches.
+type CacheStats struct {
+	Bytes     int64 `json:"bytes"`
+	Items     int64 `json:"items"`
+	Gets      int64 `json:"gets"`
+	Hits      int64 `json:"hits"`
+	Stale     int64 `json:"stale"`     // gets finding an entry past its hard TTL, not hits
+	Evictions int64 `json:"evictions"` // entries dropped for capacity or expiry
+}
+
+// CacheStats returns the stats of the given cache of the group.
+func (g *Group) CacheStats(which CacheType) CacheStats {
+	switch which {
+	case MainCache:
+		return g.mainCache.stats()
+	case HotCache:
+		return g.hotCache.stats()
+	default:
+		return CacheStats{}
+	}
+}
+
+// Name returns the name of the group.
+func (g *Group) Name() string {
+	return g.name
+}
@@ -0,0 +1,83 @@
+package geecache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	g := NewGroup("stats", 2<<10, GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			if key == "missing" {
+				return nil, fmt.Errorf("%s not exist", key)
+			}
+			return []byte("db " + key), nil
+		}))
+	ctx := context.Background()
+	g.Get(ctx, "Tom", false)
+	g.Get(ctx, "Tom", false)
+	g.Get(ctx, "missing", false)
+
+	expect := map[string]int64{
+		"gets":            3,
+		"cache_hits":      1,
+		"loads":           2,
+		"loads_deduped":   2,
+		"local_loads":     1,
+		"local_load_errs": 1,
+	}
+	got := map[string]int64{
+		"gets":            g.Stats.Gets.Get(),
+		"cache_hits":      g.Stats.CacheHits.Get(),
+		"loads":           g.Stats.Loads.Get(),
+		"loads_deduped":   g.Stats.LoadsDeduped.Get(),
+		"local_loads":     g.Stats.LocalLoads.Get(),
+		"local_load_errs": g.Stats.LocalLoadErrs.Get(),
+	}
+	for k, v := range expect {
+		if got[k] != v {
+			t.Errorf("%s = %d, expect %d", k, got[k], v)
+		}
+	}
+	cs := g.CacheStats(MainCache)
+	if cs.Items != 1 || cs.Bytes != int64(len("Tom")+len("db Tom")) || cs.Gets != 3 || cs.Hits != 1 {
+		t.Errorf("main cache stats = %+v", cs)
+	}
+}
+
+func TestServeStats(t *testing.T) {
+	groups, pools, stop := newTestCluster(2, "servestats", GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			return []byte("db " + key), nil
+		}))
+	defer stop()
+	for i := 0; i < 10; i++ {
+		groups[0].Get(context.Background(), fmt.Sprint(i), false)
+	}
+
+	res, err := http.Get(pools[0].self + "/_stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var stats map[string]struct {
+		Group     map[string]int64 `json:"group"`
+		MainCache CacheStats       `json:"main_cache"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	s, ok := stats["servestats"]
+	if !ok {
+		t.Fatalf("no stats for group servestats in %v", stats)
+	}
+	if s.Group["gets"] != 10 || s.Group["peer_loads"]+s.Group["local_loads"] != 10 {
+		t.Fatalf("group stats = %v", s.Group)
+	}
+	if s.MainCache.Items != s.Group["local_loads"] {
+		t.Fatalf("main cache holds %d items, expect %d", s.MainCache.Items, s.Group["local_loads"])
+	}
+}
@@ -0,0 +1,366 @@
+package geecache
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// A Setter persists the values written to a group. A Getter passed to
+// NewGroup that also implements Setter makes the group write every Set
+// and Add to it, on the key's owner.
+// It should give up once ctx is done.
+type Setter interface {
+	Set(ctx context.Context, key string, value []byte) error
+}
+
+// A Deleter removes keys from the backing store. A Getter passed to
+// NewGroup that also implements Deleter makes the group delete every
+// deleted key from it, on the key's owner.
+// It should give up once ctx is done.
+type Deleter interface {
+	Delete(ctx context.Context, key string) error
+}
+
+// A BatchWriter writes several changes to the backing store at once. A
+// write-behind group whose Getter also implements BatchWriter writes each
+// flushed batch with one WriteBatch call, rather than with one Set or
+// Delete per key.
+// It should give up once ctx is done.
+type BatchWriter interface {
+	WriteBatch(ctx context.Context, sets map[string][]byte, deletes []string) error
+}
+
+// WriteBehind configures a group to acknowledge writes before they reach
+// the backing store. Writes are queued, writes of the same key are
+// coalesced into the latest one, and the queue is flushed in batches,
+// see BatchWriter. Failed writes are retried on the next flushes. Zero
+// fields take their defaults. Call Close before exiting, or the writes
+// still queued are lost.
+type WriteBehind struct {
+	// FlushInterval is the time between flushes, 1s by default.
+	FlushInterval time.Duration
+	// BatchSize is the most keys written per flush, 100 by default. A
+	// queue holding a full batch is flushed without waiting.
+	BatchSize int
+	// MaxPending bounds the number of queued keys, 10000 by default.
+	// Writes of new keys wait for room while the queue is full.
+	MaxPending int
+	// MaxRetries is how often a failed write is tried again before it
+	// is dropped, 3 by default.
+	MaxRetries int
+}
+
+// WithWriteBehind makes the group write to its Setter and Deleter behind
+// the cache. Without the option writes go through to the store before
+// they are acknowledged.
+func WithWriteBehind(c WriteBehind) GroupOption {
+	return func(g *Group) {
+		if c.FlushInterval <= 0 {
+			c.FlushInterval = time.Second
+		}
+		if c.BatchSize <= 0 {
+			c.BatchSize = 100
+		}
+		if c.MaxPending <= 0 {
+			c.MaxPending = 10000
+		}
+		if c.MaxRetries <= 0 {
+			c.MaxRetries = 3
+		}
+		g.writeBehind = &c
+	}
+}
+
+// storeSet writes a value stored on this peer to the backing store.
+func (g *Group) storeSet(ctx context.Context, key string, value ByteView) error {
+	if g.setter == nil {
+		return nil
+	}
+	if g.queue != nil {
+		return g.queue.push(ctx, key, write{value: value.ByteSlice()})
+	}
+	return g.persist(ctx, key, write{value: value.ByteSlice()})
+}
+
+// storeDelete deletes a key deleted on this peer from the backing store.
+func (g *Group) storeDelete(ctx context.Context, key string) error {
+	if g.deleter == nil {
+		return nil
+	}
+	if g.queue != nil {
+		return g.queue.push(ctx, key, write{delete: true})
+	}
+	return g.persist(ctx, key, write{delete: true})
+}
+
+// persist applies one write to the backing store.
+func (g *Group) persist(ctx context.Context, key string, w write) error {
+	var err error
+	if w.delete {
+		err = g.deleter.Delete(ctx, key)
+	} else {
+		err = g.setter.Set(ctx, key, w.value)
+	}
+	if err != nil {
+		g.Stats.StoreErrs.Add(1)
+		return fmt.Errorf("writing %s to the store: %v", key, err)
+	}
+	g.Stats.StoreWrites.Add(1)
+	return nil
+}
+
+// persistBatch applies several writes to the backing store with one
+// WriteBatch call.
+func (g *Group) persistBatch(ctx context.Context, keys []string, writes []write) error {
+	sets := make(map[string][]byte)
+	var deletes []string
+	for i, key := range keys {
+		if writes[i].delete {
+			deletes = append(deletes, key)
+		} else {
+			sets[key] = writes[i].value
+		}
+	}
+	if err := g.batchWriter.WriteBatch(ctx, sets, deletes); err != nil {
+		g.Stats.StoreErrs.Add(int64(len(keys)))
+		return fmt.Errorf("writing %d keys to the store: %v", len(keys), err)
+	}
+	g.Stats.StoreWrites.Add(int64(len(keys)))
+	return nil
+}
+
+// Flush writes every queued write-behind write to the backing store and
+// reports the first failure. It does nothing for write-through groups.
+func (g *Group) Flush(ctx context.Context) error {
+	if g.queue == nil {
+		return nil
+	}
+	return g.queue.flushAll(ctx)
+}
+
+// Close stops the background flushes of a write-behind group and flushes
+// the queue like Flush. Writes made after Close reach the backing store
+// before they are acknowledged. It does nothing for write-through groups.
+func (g *Group) Close(ctx context.Context) error {
+	if g.queue == nil {
+		return nil
+	}
+	return g.queue.close(ctx)
+}
+
+// write is a pending change of one key.
+type write struct {
+	value    []byte
+	delete   bool
+	seq      uint64 // tells apart writes of the same key
+	attempts int
+}
+
+// writeQueue holds the write-behind writes of a group, at most one per
+// key, and flushes them in the background.
+type writeQueue struct {
+	g      *Group
+	config WriteBehind
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[string]write
+	order   []string      // keys of pending, oldest first
+	room    chan struct{} // closed and replaced when keys leave pending
+	kick    chan struct{} // asks the flusher to flush now
+	closed  bool          // set by close, pushes then flush at once
+	stop    chan struct{} // closed by close to stop the flusher
+	flushMu sync.Mutex    // serializes flushes
+}
+
+func newWriteQueue(g *Group, config WriteBehind) *writeQueue {
+	q := &writeQueue{
+		g:       g,
+		config:  config,
+		pending: make(map[string]write),
+		room:    make(chan struct{}),
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// push queues w, replacing a pending write of the same key. It waits for
+// room while the queue is full. Once the queue is closed, push flushes it
+// before returning.
+func (q *writeQueue) push(ctx context.Context, key string, w write) error {
+	q.mu.Lock()
+	q.seq++
+	w.seq = q.seq
+	if q.closed {
+		if _, ok := q.pending[key]; !ok {
+			q.order = append(q.order, key)
+		}
+		q.pending[key] = w
+		q.mu.Unlock()
+		return q.flushAll(ctx)
+	}
+	for {
+		if _, ok := q.pending[key]; ok {
+			q.g.Stats.WritesCoalesced.Add(1)
+			q.pending[key] = w
+			q.mu.Unlock()
+			return nil
+		}
+		if len(q.pending) < q.config.MaxPending {
+			break
+		}
+		room := q.room
+		q.mu.Unlock()
+		q.flushSoon()
+		select {
+		case <-room:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		q.mu.Lock()
+	}
+	q.pending[key] = w
+	q.order = append(q.order, key)
+	full := len(q.order) >= q.config.BatchSize
+	q.mu.Unlock()
+	if full {
+		q.flushSoon()
+	}
+	return nil
+}
+
+// lookup returns the pending write of key, if any. deleted is set for a
+// pending delete, value for a pending set.
+func (q *writeQueue) lookup(key string) (value []byte, deleted, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	w, ok := q.pending[key]
+	if !ok {
+		return nil, false, false
+	}
+	return w.value, w.delete, true
+}
+
+func (q *writeQueue) flushSoon() {
+	select {
+	case q.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (q *writeQueue) run() {
+	ticker := time.NewTicker(q.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.kick:
+		case <-q.stop:
+			return
+		}
+		q.flush(context.Background())
+	}
+}
+
+// close stops the flusher and flushes what is pending.
+func (q *writeQueue) close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.stop)
+	}
+	q.mu.Unlock()
+	return q.flushAll(ctx)
+}
+
+// flush writes one batch of the oldest pending writes and returns the
+// first error.
+func (q *writeQueue) flush(ctx context.Context) error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	n := len(q.order)
+	if n > q.config.BatchSize {
+		n = q.config.BatchSize
+	}
+	keys := append([]string(nil), q.order[:n]...)
+	batch := make([]write, n)
+	for i, key := range keys {
+		batch[i] = q.pending[key]
+	}
+	q.mu.Unlock()
+
+	errs := make([]error, n)
+	if q.g.batchWriter != nil && n > 0 {
+		err := q.g.persistBatch(ctx, keys, batch)
+		for i := range errs {
+			errs[i] = err
+		}
+	} else {
+		for i, key := range keys {
+			errs[i] = q.g.persist(ctx, key, batch[i])
+		}
+	}
+
+	var firstErr error
+	for i, key := range keys {
+		err := errs[i]
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		q.mu.Lock()
+		if cur := q.pending[key]; cur.seq != batch[i].seq {
+			// Rewritten while flushing, the new write stays queued.
+		} else if err != nil && cur.attempts < q.config.MaxRetries {
+			cur.attempts++
+			q.pending[key] = cur
+		} else {
+			if err != nil {
+				q.g.Stats.WritesDropped.Add(1)
+				log.Printf("[GeeCache] dropping write of %s after %d retries: %v", key, cur.attempts, err)
+			}
+			q.remove(key)
+		}
+		q.mu.Unlock()
+	}
+	return firstErr
+}
+
+// flushAll flushes batches until nothing is pending or ctx is done. It
+// stops at the first failed write, which stays queued for a retry.
+func (q *writeQueue) flushAll(ctx context.Context) error {
+	for {
+		q.mu.Lock()
+		empty := len(q.order) == 0
+		q.mu.Unlock()
+		if empty {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := q.flush(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// remove takes key out of pending and wakes up writers waiting for room.
+// q.mu must be held.
+func (q *writeQueue) remove(key string) {
+	delete(q.pending, key)
+	for i, k := range q.order {
+		if k == key {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+	close(q.room)
+	q.room = make(chan struct{})
+}
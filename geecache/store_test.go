@@ -0,0 +1,364 @@
+package geecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore is a backing store in memory. It implements Getter, Setter
+// and Deleter.
+type fakeStore struct {
+	mu     sync.Mutex
+	data   map[string]string
+	writes int
+	// fail fails that many writes before succeeding again
+	fail int
+	// block, if set, holds every write until it is closed
+	block chan struct{}
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{data: make(map[string]string)}
+}
+
+func (s *fakeStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[key]
+	if !ok {
+		return nil, fmt.Errorf("%s not exist", key)
+	}
+	return []byte(v), nil
+}
+
+func (s *fakeStore) Set(ctx context.Context, key string, value []byte) error {
+	return s.write(func() { s.data[key] = string(value) })
+}
+
+func (s *fakeStore) Delete(ctx context.Context, key string) error {
+	return s.write(func() { delete(s.data, key) })
+}
+
+func (s *fakeStore) write(apply func()) error {
+	s.mu.Lock()
+	block := s.block
+	s.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("store unavailable")
+	}
+	s.writes++
+	apply()
+	return nil
+}
+
+func (s *fakeStore) get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[key]
+	return v, ok
+}
+
+func (s *fakeStore) writeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes
+}
+
+func TestWriteThrough(t *testing.T) {
+	store := newFakeStore()
+	g := NewGroup("write-through", 2<<10, store)
+	ctx := context.Background()
+
+	if err := g.Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := store.get("k"); !ok || v != "v" {
+		t.Fatalf("store after Set = %q, %v; want v", v, ok)
+	}
+
+	store.fail = 1
+	if err := g.Set(ctx, "k", []byte("v2")); err == nil {
+		t.Fatal("Set succeeded with a failing store")
+	}
+	if view, err := g.Get(ctx, "k", false); err != nil || view.String() != "v" {
+		t.Errorf("Get after failed Set = %q, %v; want the old value", view.String(), err)
+	}
+
+	// A failed delete is reported, and the key is not counted as deleted.
+	store.fail = 1
+	if n, err := g.Delete(ctx, "k", false); err == nil || n != 0 {
+		t.Errorf("Delete with a failing store = %d, %v; want 0 and an error", n, err)
+	}
+	if n, err := g.Delete(ctx, "k", false); err != nil {
+		t.Fatalf("Delete = %d, %v", n, err)
+	}
+	if _, ok := store.get("k"); ok {
+		t.Errorf("store still has k after Delete")
+	}
+	if got := g.Stats.StoreWrites.Get(); got != 2 {
+		t.Errorf("StoreWrites = %d, want 2", got)
+	}
+}
+
+func TestDeleteStoreFailureThroughPeer(t *testing.T) {
+	store := newFakeStore()
+	groups, pools, stop := newTestCluster(2, "delete-store-failure", store)
+	defer stop()
+	ctx := context.Background()
+	key := remoteKey(groups[0])
+
+	if err := groups[0].Set(ctx, key, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	store.fail = 1
+	store.mu.Unlock()
+	if n, err := groups[0].Delete(ctx, key, false); err == nil || n != 0 {
+		t.Errorf("Delete with the owner's store failing = %d, %v; want 0 and an error", n, err)
+	}
+
+	store.mu.Lock()
+	store.fail = 1
+	store.mu.Unlock()
+	req, _ := http.NewRequest(http.MethodDelete, pools[0].self+"/delete-store-failure/"+key, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("DELETE with the owner's store failing: status %v, want 502", res.Status)
+	}
+	if v, ok := store.get(key); !ok || v != "v" {
+		t.Errorf("store after the failed deletes = %q, %v; want v", v, ok)
+	}
+}
+
+func TestWriteBehindCoalesces(t *testing.T) {
+	store := newFakeStore()
+	g := NewGroup("write-behind-coalesce", 2<<10, store, WithWriteBehind(WriteBehind{FlushInterval: time.Hour}))
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := g.Set(ctx, "k", []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Set(ctx, "other", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.writeCount(); n != 0 {
+		t.Fatalf("%d writes reached the store before the flush", n)
+	}
+	// A pending write is served even when the cache lost it.
+	g.mainCache.remove("k")
+	if view, err := g.Get(ctx, "k", false); err != nil || view.String() != "2" {
+		t.Errorf("Get of pending write = %q, %v; want 2", view.String(), err)
+	}
+
+	if err := g.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.writeCount(); n != 2 {
+		t.Errorf("store got %d writes, want 2", n)
+	}
+	if v, _ := store.get("k"); v != "2" {
+		t.Errorf("store has k = %q, want the latest write 2", v)
+	}
+	if got := g.Stats.WritesCoalesced.Get(); got != 2 {
+		t.Errorf("WritesCoalesced = %d, want 2", got)
+	}
+}
+
+func TestWriteBehindPendingDelete(t *testing.T) {
+	store := newFakeStore()
+	store.data["k"] = "old"
+	g := NewGroup("write-behind-delete", 2<<10, store, WithWriteBehind(WriteBehind{FlushInterval: time.Hour}))
+	ctx := context.Background()
+
+	if view, err := g.Get(ctx, "k", false); err != nil || view.String() != "old" {
+		t.Fatalf("Get = %q, %v; want old", view.String(), err)
+	}
+	g.Delete(ctx, "k", false)
+	// The store still has the key, but the pending delete stands.
+	if view, err := g.Get(ctx, "k", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of pending delete = %q, %v; want ErrNotFound", view.String(), err)
+	}
+	if err := g.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.get("k"); ok {
+		t.Errorf("store still has k after the flush")
+	}
+}
+
+func TestWriteBehindFlushesFullBatch(t *testing.T) {
+	store := newFakeStore()
+	g := NewGroup("write-behind-batch", 2<<10, store,
+		WithWriteBehind(WriteBehind{FlushInterval: time.Hour, BatchSize: 2}))
+	ctx := context.Background()
+
+	g.Set(ctx, "a", []byte("1"))
+	g.Set(ctx, "b", []byte("2"))
+	deadline := time.Now().Add(5 * time.Second)
+	for store.writeCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("a full batch was not flushed, %d writes", store.writeCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// batchStore is a fakeStore that also implements BatchWriter.
+type batchStore struct {
+	*fakeStore
+	batches int
+}
+
+func (s *batchStore) WriteBatch(ctx context.Context, sets map[string][]byte, deletes []string) error {
+	return s.write(func() {
+		s.batches++
+		for key, value := range sets {
+			s.data[key] = string(value)
+		}
+		for _, key := range deletes {
+			delete(s.data, key)
+		}
+	})
+}
+
+func TestWriteBehindBatchWriter(t *testing.T) {
+	store := &batchStore{fakeStore: newFakeStore()}
+	store.data["gone"] = "x"
+	g := NewGroup("write-behind-batch-writer", 2<<10, store,
+		WithWriteBehind(WriteBehind{FlushInterval: time.Hour, BatchSize: 10}))
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		g.Set(ctx, fmt.Sprint("k", i), []byte(fmt.Sprint(i)))
+	}
+	g.Delete(ctx, "gone", false)
+	if err := g.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.batches != 1 {
+		t.Errorf("store got %d batches, want 1", store.batches)
+	}
+	if _, ok := store.data["gone"]; ok || len(store.data) != 5 {
+		t.Errorf("store after the flush = %v", store.data)
+	}
+	if got := g.Stats.StoreWrites.Get(); got != 6 {
+		t.Errorf("StoreWrites = %d, want 6", got)
+	}
+}
+
+func TestWriteBehindClose(t *testing.T) {
+	store := newFakeStore()
+	g := NewGroup("write-behind-close", 2<<10, store, WithWriteBehind(WriteBehind{FlushInterval: time.Hour}))
+	ctx := context.Background()
+
+	g.Set(ctx, "a", []byte("1"))
+	if err := g.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := store.get("a"); v != "1" {
+		t.Errorf("store after Close has a = %q, want 1", v)
+	}
+	// Writes after Close are not left in the queue.
+	if err := g.Set(ctx, "b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := store.get("b"); v != "2" {
+		t.Errorf("store has b = %q after a Set on a closed group, want 2", v)
+	}
+}
+
+func TestWriteBehindRetries(t *testing.T) {
+	store := newFakeStore()
+	g := NewGroup("write-behind-retry", 2<<10, store,
+		WithWriteBehind(WriteBehind{FlushInterval: time.Hour, MaxRetries: 2}))
+	ctx := context.Background()
+
+	store.mu.Lock()
+	store.fail = 2
+	store.mu.Unlock()
+	g.Set(ctx, "k", []byte("v"))
+	for i := 0; i < 2; i++ {
+		if err := g.Flush(ctx); err == nil {
+			t.Fatalf("flush %d succeeded with a failing store", i)
+		}
+	}
+	if err := g.Flush(ctx); err != nil {
+		t.Fatalf("third flush: %v", err)
+	}
+	if v, ok := store.get("k"); !ok || v != "v" {
+		t.Errorf("store after retries = %q, %v; want v", v, ok)
+	}
+
+	// A write failing more than MaxRetries times is dropped.
+	store.mu.Lock()
+	store.fail = 3
+	store.mu.Unlock()
+	g.Set(ctx, "k", []byte("lost"))
+	for i := 0; i < 3; i++ {
+		g.Flush(ctx)
+	}
+	if err := g.Flush(ctx); err != nil {
+		t.Errorf("flush after the drop: %v", err)
+	}
+	if got := g.Stats.WritesDropped.Get(); got != 1 {
+		t.Errorf("WritesDropped = %d, want 1", got)
+	}
+	if v, _ := store.get("k"); v != "v" {
+		t.Errorf("store has k = %q, want v", v)
+	}
+}
+
+func TestWriteBehindBoundedQueue(t *testing.T) {
+	store := newFakeStore()
+	store.block = make(chan struct{})
+	g := NewGroup("write-behind-bounded", 2<<10, store,
+		WithWriteBehind(WriteBehind{FlushInterval: time.Hour, MaxPending: 2}))
+	ctx := context.Background()
+
+	g.Set(ctx, "a", []byte("1"))
+	g.Set(ctx, "b", []byte("2"))
+	// Writes of pending keys are coalesced and never wait.
+	if err := g.Set(ctx, "a", []byte("3")); err != nil {
+		t.Fatalf("coalesced Set on a full queue: %v", err)
+	}
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := g.Set(short, "c", []byte("4")); err != context.DeadlineExceeded {
+		t.Fatalf("Set on a full queue = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	store.mu.Lock()
+	close(store.block)
+	store.block = nil
+	store.mu.Unlock()
+	if err := g.Set(ctx, "c", []byte("4")); err != nil {
+		t.Fatalf("Set after the store recovered: %v", err)
+	}
+	if err := g.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "3", "b": "2", "c": "4"} {
+		if v, _ := store.get(key); v != want {
+			t.Errorf("store has %s = %q, want %q", key, v, want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package tinylfu
+
+import "hash/fnv"
+
+// sketchDepth is the number of rows of the count-min sketch.
+const sketchDepth = 4
+
+// sketchSeeds mixes the key hash differently for every row.
+var sketchSeeds = [sketchDepth]uint64{
+	0xc3a5c85c97cb3127, 0xb492b66fbe98f273,
+	0x9ae16a3b2f90404f, 0xcbf29ce484222325,
+}
+
+// sketch is a count-min sketch of 8 bit counters estimating how often
+// keys were seen. Counters are halved every resetAt increments, so old
+// popularity fades away.
+type sketch struct {
+	rows    [sketchDepth][]uint8
+	mask    uint64
+	adds    int
+	resetAt int
+}
+
+// newSketch returns a sketch with at least width counters per row.
+func newSketch(width int) *sketch {
+	w := 16
+	for w < width {
+		w <<= 1
+	}
+	s := &sketch{mask: uint64(w - 1), resetAt: 10 * w}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	return s
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func (s *sketch) index(h uint64, row int) uint64 {
+	h ^= sketchSeeds[row]
+	h *= 0x9e3779b97f4a7c15
+	return (h ^ h>>32) & s.mask
+}
+
+// increment records one more occurrence of the key.
+func (s *sketch) increment(key string) {
+	h := hashKey(key)
+	for i := range s.rows {
+		idx := s.index(h, i)
+		if s.rows[i][idx] < 255 {
+			s.rows[i][idx]++
+		}
+	}
+	s.adds++
+	if s.adds >= s.resetAt {
+		s.reset()
+	}
+}
+
+// estimate returns how often the key was seen, possibly overcounting.
+func (s *sketch) estimate(key string) uint8 {
+	h := hashKey(key)
+	min := uint8(255)
+	for i := range s.rows {
+		if v := s.rows[i][s.index(h, i)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// reset halves every counter.
+func (s *sketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.adds /= 2
+}
@@ -0,0 +1,279 @@
+package tinylfu
+
+import (
+	"container/list"
+	"geecache/lru"
+	"time"
+)
+
+// segment names the list holding an entry.
+type segment int
+
+const (
+	window segment = iota
+	probation
+	protected
+)
+
+const (
+	// windowPercent is the share of the bytes given to the window LRU.
+	windowPercent = 1
+	// protectedPercent is the share of the main cache given to entries
+	// that were hit at least once after admission.
+	protectedPercent = 80
+)
+
+// Cache is a W-TinyLFU cache bounded by bytes. It is not safe for
+// concurrent access.
+//
+// New entries go to a small window LRU. Entries leaving the window must
+// win against the main cache's eviction victim, comparing how often both
+// keys were seen according to a count-min sketch, so one-off keys of a
+// scan never push out popular ones. The main cache is a segmented LRU of
+// a probation and a protected part.
+type Cache struct {
+	maxBytes     int64
+	windowMax    int64
+	protectedMax int64
+	mainMax      int64
+	lists        [3]*list.List // indexed by segment, most recent at the front
+	bytes        [3]int64      // indexed by segment
+	cache        map[string]*list.Element
+	sketch       *sketch
+	// optional and executed when an entry is purged.
+	OnEvicted func(key string, value lru.Value, reason lru.EvictReason)
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+type entry struct {
+	key   string
+	value lru.Value
+	seg   segment
+	// expire is the deadline of the entry, zero means it never expires
+	expire time.Time
+}
+
+// expired reports whether the entry's deadline has passed at t.
+func (e *entry) expired(t time.Time) bool {
+	return !e.expire.IsZero() && !t.Before(e.expire)
+}
+
+func (e *entry) size() int64 {
+	return int64(len(e.key)) + int64(e.value.Len())
+}
+
+// New is the Constructor of Cache
+func New(maxBytes int64, onEvicted func(string, lru.Value, lru.EvictReason)) *Cache {
+	windowMax := maxBytes * windowPercent / 100
+	mainMax := maxBytes - windowMax
+	// Guess the number of entries from the bytes to size the sketch.
+	width := 1 << 16
+	if maxBytes != 0 {
+		width = int(maxBytes / 64)
+		if width < 1<<10 {
+			width = 1 << 10
+		} else if width > 1<<20 {
+			width = 1 << 20
+		}
+	}
+	c := &Cache{
+		maxBytes:     maxBytes,
+		windowMax:    windowMax,
+		mainMax:      mainMax,
+		protectedMax: mainMax * protectedPercent / 100,
+		cache:        make(map[string]*list.Element),
+		sketch:       newSketch(width),
+		OnEvicted:    onEvicted,
+		now:          time.Now,
+	}
+	for i := range c.lists {
+		c.lists[i] = list.New()
+	}
+	return c
+}
+
+// Add adds a value to the cache.
+func (c *Cache) Add(key string, value lru.Value) {
+	c.AddWithTTL(key, value, 0)
+}
+
+// AddWithTTL adds a value to the cache that expires after ttl.
+// A ttl <= 0 means the value never expires.
+func (c *Cache) AddWithTTL(key string, value lru.Value, ttl time.Duration) {
+	var expire time.Time
+	if ttl > 0 {
+		expire = c.now().Add(ttl)
+	}
+	if ele, ok := c.cache[key]; ok {
+		kv := ele.Value.(*entry)
+		c.unlink(ele)
+		kv.value = value
+		kv.expire = expire
+		c.push(kv.seg, kv)
+	} else {
+		c.sketch.increment(key)
+		c.push(window, &entry{key: key, value: value, expire: expire})
+	}
+	c.evict()
+}
+
+// Get look ups a key's value
+// An expired entry reads as a miss and is removed.
+func (c *Cache) Get(key string) (value lru.Value, ok bool) {
+	c.sketch.increment(key)
+	ele, ok := c.cache[key]
+	if !ok {
+		return
+	}
+	kv := ele.Value.(*entry)
+	if kv.expired(c.now()) {
+		c.removeElement(ele, lru.EvictExpired)
+		return nil, false
+	}
+	c.unlink(ele)
+	if kv.seg == probation {
+		c.push(protected, kv)
+		// Demote the oldest protected entries to make room.
+		for c.bytes[protected] > c.protectedMax && c.lists[protected].Len() > 1 {
+			old := c.lists[protected].Back()
+			c.unlink(old)
+			c.push(probation, old.Value.(*entry))
+		}
+	} else {
+		c.push(kv.seg, kv)
+	}
+	return kv.value, true
+}
+
+// Peek looks up a key's value like Get, without marking it used. An
+// expired entry reads as a miss but is left to be reclaimed.
+func (c *Cache) Peek(key string) (value lru.Value, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		if kv := ele.Value.(*entry); !kv.expired(c.now()) {
+			return kv.value, true
+		}
+	}
+	return
+}
+
+// Remove removes the key you need and reports whether it was present.
+// An expired entry is reclaimed but reported as absent.
+func (c *Cache) Remove(key string) bool {
+	if ele, hit := c.cache[key]; hit {
+		if ele.Value.(*entry).expired(c.now()) {
+			c.removeElement(ele, lru.EvictExpired)
+			return false
+		}
+		c.removeElement(ele, lru.EvictDeleted)
+		return true
+	}
+	return false
+}
+
+// RemoveExpired removes every expired entry and returns how many were removed.
+func (c *Cache) RemoveExpired() int {
+	now := c.now()
+	removed := 0
+	for _, ele := range c.cache {
+		if ele.Value.(*entry).expired(now) {
+			c.removeElement(ele, lru.EvictExpired)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Range calls f for every entry that has not expired, with the time it
+// has left or 0 if it never expires, until f returns false. f must not
+// modify the cache.
+func (c *Cache) Range(f func(key string, value lru.Value, ttl time.Duration) bool) {
+	now := c.now()
+	for key, ele := range c.cache {
+		kv := ele.Value.(*entry)
+		if kv.expired(now) {
+			continue
+		}
+		var ttl time.Duration
+		if !kv.expire.IsZero() {
+			ttl = kv.expire.Sub(now)
+		}
+		if !f(key, kv.value, ttl) {
+			return
+		}
+	}
+}
+
+// Len the number of cache entries
+func (c *Cache) Len() int {
+	return len(c.cache)
+}
+
+// Bytes the number of bytes taken by keys and values
+func (c *Cache) Bytes() int64 {
+	return c.bytes[window] + c.bytes[probation] + c.bytes[protected]
+}
+
+// evict moves entries overflowing the window into the main cache, where
+// they have to win admission, and then shrinks the main cache to fit.
+func (c *Cache) evict() {
+	if c.maxBytes == 0 {
+		return
+	}
+	for c.bytes[window] > c.windowMax {
+		ele := c.lists[window].Back()
+		kv := ele.Value.(*entry)
+		c.unlink(ele)
+		c.admit(kv)
+	}
+	for c.bytes[probation]+c.bytes[protected] > c.mainMax {
+		c.removeElement(c.victim(), lru.EvictCapacity)
+	}
+}
+
+// admit moves a candidate from the window into the main cache if it is
+// seen more often than the entries it would push out.
+func (c *Cache) admit(kv *entry) {
+	for c.bytes[probation]+c.bytes[protected]+kv.size() > c.mainMax {
+		victim := c.victim()
+		if victim == nil || c.sketch.estimate(kv.key) <= c.sketch.estimate(victim.Value.(*entry).key) {
+			// The candidate loses, it is already unlinked.
+			if c.OnEvicted != nil {
+				c.OnEvicted(kv.key, kv.value, lru.EvictCapacity)
+			}
+			return
+		}
+		c.removeElement(victim, lru.EvictCapacity)
+	}
+	c.push(probation, kv)
+}
+
+// victim returns the main cache's next entry to evict, or nil if it is empty.
+func (c *Cache) victim() *list.Element {
+	if ele := c.lists[probation].Back(); ele != nil {
+		return ele
+	}
+	return c.lists[protected].Back()
+}
+
+func (c *Cache) push(seg segment, kv *entry) {
+	kv.seg = seg
+	c.cache[kv.key] = c.lists[seg].PushFront(kv)
+	c.bytes[seg] += kv.size()
+}
+
+// unlink takes the element out of its list and the byte counts.
+func (c *Cache) unlink(ele *list.Element) {
+	kv := ele.Value.(*entry)
+	c.lists[kv.seg].Remove(ele)
+	delete(c.cache, kv.key)
+	c.bytes[kv.seg] -= kv.size()
+}
+
+func (c *Cache) removeElement(ele *list.Element, reason lru.EvictReason) {
+	kv := ele.Value.(*entry)
+	c.unlink(ele)
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value, reason)
+	}
+}
@@ -0,0 +1,102 @@
+package tinylfu
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestGet(t *testing.T) {
+	c := New(int64(0), nil)
+	c.Add("key1", String("1234"))
+	if v, ok := c.Get("key1"); !ok || string(v.(String)) != "1234" {
+		t.Fatalf("cache hit key1=1234 failed")
+	}
+	if _, ok := c.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+}
+
+func TestPeek(t *testing.T) {
+	c := New(int64(0), nil)
+	c.Add("key1", String("1234"))
+	before := c.sketch.estimate("key1")
+	if v, ok := c.Peek("key1"); !ok || string(v.(String)) != "1234" {
+		t.Fatalf("peek key1=1234 failed")
+	}
+	if _, ok := c.Peek("key2"); ok {
+		t.Fatalf("peek miss key2 failed")
+	}
+	if after := c.sketch.estimate("key1"); after != before {
+		t.Fatalf("peek raised key1's estimate from %d to %d", before, after)
+	}
+}
+
+func TestSketch(t *testing.T) {
+	s := newSketch(64)
+	for i := 0; i < 10; i++ {
+		s.increment("hot")
+	}
+	s.increment("cold")
+	if s.estimate("hot") < 10 || s.estimate("cold") < 1 || s.estimate("cold") >= 10 {
+		t.Fatalf("estimates hot=%d cold=%d", s.estimate("hot"), s.estimate("cold"))
+	}
+	s.reset()
+	if s.estimate("hot") != 5 {
+		t.Fatalf("estimate after reset = %d, expect 5", s.estimate("hot"))
+	}
+}
+
+func TestScanResistance(t *testing.T) {
+	c := New(int64(1000), nil)
+	hot := make([]string, 20)
+	for i := range hot {
+		hot[i] = fmt.Sprintf("hot%02d", i)
+		c.Add(hot[i], String("0123456789"))
+	}
+	for round := 0; round < 5; round++ {
+		for _, k := range hot {
+			c.Get(k)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("scan%04d", i)
+		if _, ok := c.Get(key); !ok {
+			c.Add(key, String("0123456789"))
+		}
+	}
+	for _, k := range hot {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("hot key %s was flushed by a scan", k)
+		}
+	}
+	if c.Bytes() > 1000 {
+		t.Fatalf("cache holds %d bytes, more than 1000", c.Bytes())
+	}
+}
+
+func TestRemove(t *testing.T) {
+	now := time.Now()
+	c := New(int64(0), nil)
+	c.now = func() time.Time { return now }
+	c.Add("key1", String("1234"))
+	c.Get("key1")
+	c.AddWithTTL("key2", String("5678"), time.Second)
+
+	if !c.Remove("key1") || c.Remove("key1") {
+		t.Fatalf("Remove key1 should succeed exactly once")
+	}
+	now = now.Add(time.Second)
+	if _, ok := c.Get("key2"); ok {
+		t.Fatalf("expired key2 should read as a miss")
+	}
+	if c.Len() != 0 || c.Bytes() != 0 {
+		t.Fatalf("len=%d bytes=%d after removing everything", c.Len(), c.Bytes())
+	}
+}
@@ -0,0 +1,42 @@
+package geecache
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// WithEarlyRefresh makes Get reload a cached value in the background
+// shortly before its deadline, the soft TTL if set, else the hard TTL.
+// The chance grows as the deadline nears and with how long the Getter
+// took to load the value, as in XFetch ("Optimal Probabilistic Cache
+// Stampede Prevention", Vattani et al.), so keys loaded together are not
+// all reloaded together. beta scales the chance: 1 is the usual choice,
+// larger values refresh earlier, 0 turns early refresh off.
+func WithEarlyRefresh(beta float64) GroupOption {
+	return func(g *Group) {
+		g.earlyRefresh = beta
+	}
+}
+
+// refreshEarly reports whether v, found in the cache at now, is to be
+// refreshed before its deadline.
+func (g *Group) refreshEarly(v ByteView, now time.Time) bool {
+	deadline := v.fresh
+	if deadline.IsZero() {
+		deadline = v.expires
+	}
+	if g.earlyRefresh <= 0 || deadline.IsZero() || v.delta <= 0 {
+		return false
+	}
+	return xfetch(now, deadline, v.delta, g.earlyRefresh, 1-rand.Float64())
+}
+
+// xfetch reports whether a value expiring at deadline, which took delta
+// to load, is to be refreshed at now, given r drawn uniformly from (0, 1].
+// The value is refreshed once now is within delta * beta * -ln(r) of the
+// deadline.
+func xfetch(now, deadline time.Time, delta time.Duration, beta, r float64) bool {
+	gap := time.Duration(float64(delta) * beta * -math.Log(r))
+	return !now.Add(gap).Before(deadline)
+}
@@ -0,0 +1,82 @@
+package geecache
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEarlyRefresh(t *testing.T) {
+	var calls int32
+	g := NewGroup("early-refresh", 2<<10, GetterFunc(
+		func(ctx context.Context, key string) ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(time.Millisecond)
+			return []byte("v"), nil
+		}), WithTTL(time.Minute), WithEarlyRefresh(1e9))
+	ctx := context.Background()
+
+	// With such a beta, a minute is well within reach of the deadline.
+	for i := 0; i < 2; i++ {
+		if view, err := g.Get(ctx, "k", false); err != nil || view.String() != "v" || view.Stale() {
+			t.Fatalf("Get %d = %q, stale %t, err %v", i, view.String(), view.Stale(), err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("no early refresh")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := g.Stats.EarlyRefreshes.Get(); n != 1 {
+		t.Errorf("EarlyRefreshes = %d, want 1", n)
+	}
+}
+
+// TestEarlyRefreshSmoothsReloads simulates keys loaded at the same time
+// and read every tick, and compares the most reloads in one tick with and
+// without early refresh.
+func TestEarlyRefreshSmoothsReloads(t *testing.T) {
+	const (
+		keys  = 1000
+		ttl   = 10 * time.Second
+		delta = time.Second
+		tick  = 100 * time.Millisecond
+		ticks = 600
+	)
+	peak := func(beta float64) int {
+		rnd := rand.New(rand.NewSource(1))
+		start := time.Unix(0, 0)
+		deadlines := make([]time.Time, keys)
+		for i := range deadlines {
+			deadlines[i] = start.Add(ttl)
+		}
+		most := 0
+		for i := 1; i <= ticks; i++ {
+			now := start.Add(time.Duration(i) * tick)
+			reloads := 0
+			for k, deadline := range deadlines {
+				if !now.Before(deadline) || beta > 0 && xfetch(now, deadline, delta, beta, 1-rnd.Float64()) {
+					deadlines[k] = now.Add(delta + ttl)
+					reloads++
+				}
+			}
+			if reloads > most {
+				most = reloads
+			}
+		}
+		return most
+	}
+
+	without, with := peak(0), peak(1)
+	t.Logf("most reloads in a tick: %d without early refresh, %d with", without, with)
+	if without != keys {
+		t.Errorf("without early refresh, %d keys reloaded together, want all %d", without, keys)
+	}
+	if with > keys/4 {
+		t.Errorf("with early refresh, %d keys reloaded together, want at most %d", with, keys/4)
+	}
+}
@@ -1,7 +1,17 @@
 module example
 
-go 1.13
+go 1.17
 
 require geecache v0.0.0
 
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+	google.golang.org/grpc v1.54.0 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
+)
+
 replace geecache => ./geecache
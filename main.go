@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"geecache"
+	"geecache/gossip"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var db = map[string]string{
@@ -14,44 +25,227 @@ var db = map[string]string{
 	"Sam":  "567",
 }
 
-var addrMap = map[int]string{
-	9527: "http://cache-server-1:9527",
-	9528: "http://cache-server-2:9528",
-	9529: "http://cache-server-3:9529",
+// policies maps the -policy flag to an eviction policy.
+var policies = map[string]geecache.PolicyFunc{
+	"lru":     geecache.LRU,
+	"lfu":     geecache.LFU,
+	"arc":     geecache.ARC,
+	"tinylfu": geecache.TinyLFU,
 }
 
-func createGroup() *geecache.Group {
+// config describes the cluster membership of this node.
+// It can be loaded from a JSON file, e.g.
+//
+//	{"self": "http://cache-server-1:9527",
+//	 "peers": ["http://cache-server-1:9527", "http://cache-server-2:9528"]}
+type config struct {
+	Self  string   `json:"self"`
+	Peers []string `json:"peers"`
+}
+
+func createGroup(ttl time.Duration, policy geecache.PolicyFunc, opts ...geecache.GroupOption) *geecache.Group {
 	return geecache.NewGroup("scores", 2<<30, geecache.GetterFunc(
-		func(key string) ([]byte, error) {
+		func(ctx context.Context, key string) ([]byte, error) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
 			log.Println("[SlowDB] search key", key)
 			if v, ok := db[key]; ok {
 				return []byte(v), nil
 			}
-			return nil, fmt.Errorf("%s not exist", key)
-		}))
+			return nil, fmt.Errorf("%s not exist: %w", key, geecache.ErrNotFound)
+		}), append([]geecache.GroupOption{geecache.WithTTL(ttl), geecache.WithPolicy(policy)}, opts...)...)
 }
 
-func startCacheServer(addr string, addrs []string, gee *geecache.Group) {
-	log.Println(addr)
+func startCacheServer(addr string, addrs []string, join string, useGossip bool, handoffRate int64, groups ...*geecache.Group) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Port() == "" {
+		log.Fatalf("invalid self address %q", addr)
+	}
 	peers := geecache.NewHTTPPool(addr)
 	peers.Set(addrs...)
-	gee.RegisterPeers(peers)
+	peers.SetDefaultGroup("scores")
+	peers.SetHandoffRate(handoffRate)
+	for _, g := range groups {
+		g.RegisterPeers(peers)
+	}
+	lis, err := net.Listen("tcp", ":"+u.Port())
+	if err != nil {
+		log.Fatal(err)
+	}
+	var m *gossip.Memberlist
+	if useGossip {
+		m = peers.StartGossip(gossip.Config{})
+	}
+	go leaveOnSignal(addr, peers, m, groups)
+	if join != "" {
+		go joinCluster(join, addr)
+	}
 	log.Println("geecache is running at", addr)
-	log.Fatal(http.ListenAndServe(addr[7:], peers))
+	log.Fatal(http.Serve(lis, peers))
+}
+
+// leaveOnSignal leaves the cluster gracefully when the node is asked to
+// stop: it hands its cached entries over to the nodes taking its keys,
+// writes the queued writes of groups to the store, then tells the other
+// nodes that it left, through gossip if m is set and the membership admin
+// API otherwise, so they need not wait for it to time out.
+func leaveOnSignal(self string, peers *geecache.HTTPPool, m *gossip.Memberlist, groups []*geecache.Group) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := peers.Drain(ctx); err != nil {
+		log.Println("draining the cache:", err)
+	}
+	for _, g := range groups {
+		if err := g.Close(ctx); err != nil {
+			log.Println("flushing the writes:", err)
+		}
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if m != nil {
+		m.Leave(ctx)
+	} else if err := leaveCluster(ctx, self); err != nil {
+		log.Println("leaving the cluster:", err)
+	}
+	os.Exit(0)
+}
+
+// leaveCluster asks this node, at self, to remove itself from the
+// cluster. Like for a join, it sends the new membership to the others.
+func leaveCluster(ctx context.Context, self string) error {
+	u := strings.TrimSuffix(self, "/") + "/_peers?peer=" + url.QueryEscape(self)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+	return nil
+}
+
+// joinCluster asks the running node at addr to add self to the cluster.
+// The node sends the whole membership back to self and to every other
+// node. It retries for a while, as nodes may start in any order.
+func joinCluster(addr, self string) {
+	u := strings.TrimSuffix(addr, "/") + "/_peers?peer=" + url.QueryEscape(self)
+	for attempt := 1; ; attempt++ {
+		res, err := http.Post(u, "", nil)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				log.Println("joined the cluster through", addr)
+				return
+			}
+			err = fmt.Errorf("server returned: %v", res.Status)
+		}
+		if attempt == 10 {
+			log.Fatalf("joining the cluster through %s: %v", addr, err)
+		}
+		log.Printf("joining the cluster through %s: %v, retrying", addr, err)
+		time.Sleep(time.Second)
+	}
+}
+
+// loadConfig reads the membership from a JSON file.
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// splitPeers splits a comma separated peer list, dropping empty items.
+func splitPeers(s string) []string {
+	var peers []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			peers = append(peers, p)
+		}
+	}
+	return peers
 }
 
 func main() {
-	var port int
-	var api bool
-	flag.IntVar(&port, "port", 8001, "Geecache server port")
-	flag.BoolVar(&api, "api", false, "Start a api server?")
+	var self, peers, configPath, join, policy string
+	var useGossip bool
+	var earlyRefresh float64
+	var ttl, negativeTTL, softTTL, staleOnError time.Duration
+	var handoffRate, hotBytes int64
+	var replication geecache.Replication
+	flag.StringVar(&self, "self", os.Getenv("GEECACHE_SELF"), "This node's address, e.g. http://cache-server-1:9527 (env GEECACHE_SELF)")
+	flag.StringVar(&peers, "peers", os.Getenv("GEECACHE_PEERS"), "Comma separated addresses of all nodes (env GEECACHE_PEERS)")
+	flag.StringVar(&configPath, "config", os.Getenv("GEECACHE_CONFIG"), "JSON file holding self and peers (env GEECACHE_CONFIG)")
+	flag.StringVar(&join, "join", os.Getenv("GEECACHE_JOIN"), "Address of a running node to join the cluster through (env GEECACHE_JOIN)")
+	flag.BoolVar(&useGossip, "gossip", os.Getenv("GEECACHE_GOSSIP") != "", "Detect failed nodes with gossip and route around them (env GEECACHE_GOSSIP)")
+	flag.DurationVar(&ttl, "ttl", 0, "Default lifetime of cached values, 0 means forever")
+	flag.DurationVar(&softTTL, "soft-ttl", 0, "Age after which cached values are reloaded in the background, 0 turns it off")
+	flag.DurationVar(&staleOnError, "stale-on-error", 0, "How long past -ttl a value is kept to be served if reloading it fails")
+	flag.Float64Var(&earlyRefresh, "early-refresh", 1, "How early values are reloaded before they expire, scaled by their load time, 0 turns it off")
+	flag.DurationVar(&negativeTTL, "negative-ttl", 5*time.Second, "How long a missing key is remembered, 0 turns it off")
+	flag.StringVar(&policy, "policy", "lru", "Eviction policy: lru, lfu, arc or tinylfu")
+	flag.Int64Var(&hotBytes, "hot-cache-bytes", 0, "Size of the cache of popular keys owned by other nodes, 0 for none; hot copies may be stale after writes through other nodes")
+	flag.IntVar(&replication.N, "replicas", 1, "Number of nodes holding every key")
+	flag.IntVar(&replication.R, "read-quorum", 0, "Replicas read by a get, a majority by default")
+	flag.IntVar(&replication.W, "write-quorum", 0, "Replicas that must store a write, a majority by default")
+	flag.Int64Var(&handoffRate, "handoff-rate", 10<<20, "Bytes per second at which cached entries are handed over to their new owners, 0 for no limit")
 	flag.Parse()
 
-	var addrs []string
-	for _, v := range addrMap {
-		addrs = append(addrs, v)
+	// Flags and environment variables take precedence over the config file.
+	cfg := &config{}
+	if configPath != "" {
+		var err error
+		if cfg, err = loadConfig(configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if self != "" {
+		cfg.Self = self
+	}
+	if peers != "" {
+		cfg.Peers = splitPeers(peers)
+	}
+	if cfg.Self == "" {
+		log.Fatal("self address is required, use -self, GEECACHE_SELF or -config")
+	}
+
+	addrs := cfg.Peers
+	found := false
+	for _, p := range addrs {
+		found = found || p == cfg.Self
+	}
+	if !found {
+		addrs = append(addrs, cfg.Self)
 	}
 
-	gee := createGroup()
-	startCacheServer(addrMap[port], addrs, gee)
+	if policies[policy] == nil {
+		log.Fatalf("unknown eviction policy %q", policy)
+	}
+
+	opts := []geecache.GroupOption{
+		geecache.WithNegativeTTL(negativeTTL),
+		geecache.WithSoftTTL(softTTL),
+		geecache.WithStaleOnError(staleOnError),
+		geecache.WithEarlyRefresh(earlyRefresh),
+		geecache.WithHotCache(geecache.HotCacheConfig{Bytes: hotBytes}),
+	}
+	if replication.N > 1 {
+		opts = append(opts, geecache.WithReplication(replication))
+	}
+	gee := createGroup(ttl, policies[policy], opts...)
+	startCacheServer(cfg.Self, addrs, join, useGossip, handoffRate, gee)
 }
@@ -1,16 +1,17 @@
 #!/bin/bash
 trap "rm server;kill 0" EXIT
 
+export GEECACHE_PEERS="http://localhost:9527,http://localhost:9528,http://localhost:9529"
+
 go build -o server
-./server -port=8001 &
-./server -port=8002 &
-#./server -port=8003 &
-./server -port=8003 -api=1&
+./server -self=http://localhost:9527 &
+./server -self=http://localhost:9528 &
+./server -self=http://localhost:9529 &
 
 sleep 2
 echo ">>> start test"
-curl "http://localhost:9999/api?key=Tom" &
-curl "http://localhost:9999/api?key=Tom" &
-curl "http://localhost:9999/api?key=Tom" &
+curl "http://localhost:9527/Tom" &
+curl "http://localhost:9528/Tom" &
+curl "http://localhost:9529/Tom" &
 
-wait
\ No newline at end of file
+wait